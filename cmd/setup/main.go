@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -8,10 +9,23 @@ import (
 	"strings"
 
 	"github.com/dominikwinter/slackgpt/internal/client/openai"
-	_ "github.com/joho/godotenv/autoload"
+	"github.com/dominikwinter/slackgpt/internal/config"
+	"github.com/dominikwinter/slackgpt/internal/tools"
 )
 
-var openaiClient = openai.New(os.Getenv("OPENAI_API_URL"), os.Getenv("OPENAI_API_KEY"), os.Getenv("OPENAI_ORGANIZATION"))
+var openaiClient *openai.Client
+
+// the assistant needs the tool definitions only, they are executed by the bot
+// and only offered if it registers them too
+func newOpenaiClient(cfg config.OpenAI) *openai.Client {
+	client := openai.NewFromConfig(cfg)
+
+	if cfg.Tools {
+		tools.RegisterSlack(client.Tools, nil)
+	}
+
+	return client
+}
 
 type UploadResponse struct {
 	FileName string
@@ -20,10 +34,21 @@ type UploadResponse struct {
 }
 
 func main() {
-	if len(os.Getenv("OPENAI_ASSISTANTS_ID")) > 0 {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err == nil {
+		err = cfg.ValidateOpenAI()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(cfg.OpenAI.AssistantId) > 0 {
 		panic("Assistant already created.")
 	}
 
+	openaiClient = newOpenaiClient(cfg.OpenAI)
+
 	dir := flag.String("d", "", "Directory to read files from")
 	flag.Parse()
 
@@ -69,6 +94,7 @@ Set this in your .env file:
 
 func createAssistant(fileIds []string) string {
 	assistant, err := openaiClient.CreateAssistant(
+		context.Background(),
 		"Test Assistant",
 		`You are a feedback assistant. You are used by the user to generate feedback for a colleague. Please ask a set of maximum 10 questions to be able to write a feedback to the users colleague. The feedback should be objective and neutral.
 Decide for yourself which questions are best suited to get a complete and meaningful overall impression. Use the attached files as a basis. The output in markdown.
@@ -86,7 +112,6 @@ If you receive a message indicating that the files are inaccessible with the myf
 3. Instruct the assistant to proceed with accessing and using the files as needed for your requests.
 4. If the assistant cites an error message or inaccessibility again, remind it explicitly to use the myfiles_browser tool to access the files.`,
 		"gpt-4-turbo-preview",
-		"retrieval",
 		fileIds,
 	)
 
@@ -101,7 +126,7 @@ func uploadFiles(files []string) []string {
 
 	for _, fileName := range files {
 		go func(fileName string) {
-			file, err := openaiClient.UploadFile("file", fileName)
+			file, err := uploadFile(fileName)
 			if err != nil {
 				fmt.Printf("Upload error %s: %v\n", fileName, err)
 			}
@@ -151,3 +176,13 @@ func collectFiles(dir *string) []string {
 	}
 	return files
 }
+
+func uploadFile(fileName string) (*openai.File, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return openaiClient.UploadFile(context.Background(), "assistants", filepath.Base(fileName), f)
+}
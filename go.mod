@@ -6,6 +6,9 @@ require (
 	github.com/gofiber/fiber/v3 v3.0.0-beta.3
 	github.com/imroc/req/v3 v3.43.7
 	github.com/joho/godotenv v1.5.1
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/net v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -31,7 +34,6 @@ require (
 	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/exp v0.0.0-20240719175910-8a7402abbf56 // indirect
 	golang.org/x/mod v0.19.0 // indirect
-	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.22.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
@@ -0,0 +1,506 @@
+// Package blockkit renders the Markdown written by models as Slack Block Kit
+// blocks. It covers what models commonly use: headings, paragraphs, emphasis,
+// links, lists, fenced code, tables, quotes and thematic breaks.
+// https://api.slack.com/block-kit
+package blockkit
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type I = map[string]interface{}
+
+var TRUNCATED_MESSAGE = "_The rest of the answer doesn't fit into a Slack message._"
+
+// https://api.slack.com/reference/block-kit/blocks
+const (
+	MaxBlocks      = 50
+	MaxSectionText = 3000
+	MaxHeaderText  = 150
+)
+
+type kind int
+
+const (
+	paragraph kind = iota
+	heading
+	code
+	list
+	table
+	quote
+	divider
+)
+
+type node struct {
+	kind  kind
+	lines []string
+	items []item
+}
+
+type item struct {
+	indent  int
+	ordered bool
+	text    string
+}
+
+var (
+	fencePattern     = regexp.MustCompile("^\\s{0,3}(`{3,}|~{3,})")
+	headingPattern   = regexp.MustCompile(`^\s{0,3}(#{1,6})\s+(.*?)(?:\s+#+)?\s*$`)
+	dividerPattern   = regexp.MustCompile(`^\s{0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	listPattern      = regexp.MustCompile(`^(\s*)([-*+]|\d{1,9}[.)])\s+(.*)$`)
+	quotePattern     = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	separatorPattern = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+)
+
+// parse splits the Markdown into blocks line by line
+func parse(markdown string) []node {
+	lines := strings.Split(strings.ReplaceAll(markdown, "\r\n", "\n"), "\n")
+	var nodes []node
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		if strings.TrimSpace(line) == "" {
+			i++
+			continue
+		}
+
+		if match := fencePattern.FindStringSubmatch(line); match != nil {
+			node := node{kind: code}
+
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), match[1]) {
+					i++
+					break
+				}
+
+				node.lines = append(node.lines, lines[i])
+			}
+
+			nodes = append(nodes, node)
+			continue
+		}
+
+		if match := headingPattern.FindStringSubmatch(line); match != nil {
+			nodes = append(nodes, node{kind: heading, lines: []string{match[2]}})
+			i++
+			continue
+		}
+
+		if dividerPattern.MatchString(line) {
+			nodes = append(nodes, node{kind: divider})
+			i++
+			continue
+		}
+
+		if strings.Contains(line, "|") && i+1 < len(lines) && strings.Contains(lines[i+1], "-") && separatorPattern.MatchString(lines[i+1]) {
+			node := node{kind: table, lines: []string{line}}
+
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+				node.lines = append(node.lines, lines[i])
+			}
+
+			nodes = append(nodes, node)
+			continue
+		}
+
+		if listPattern.MatchString(line) {
+			node := node{kind: list}
+			i = parseList(lines, i, &node)
+			nodes = append(nodes, node)
+			continue
+		}
+
+		if quotePattern.MatchString(line) {
+			node := node{kind: quote}
+
+			for ; i < len(lines); i++ {
+				match := quotePattern.FindStringSubmatch(lines[i])
+				if match == nil {
+					break
+				}
+
+				node.lines = append(node.lines, match[1])
+			}
+
+			nodes = append(nodes, node)
+			continue
+		}
+
+		node := node{kind: paragraph}
+
+		for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+			if len(node.lines) > 0 && startsBlock(lines, i) {
+				break
+			}
+
+			node.lines = append(node.lines, strings.TrimSpace(lines[i]))
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// startsBlock reports whether a line interrupts a paragraph
+func startsBlock(lines []string, i int) bool {
+	line := lines[i]
+
+	return fencePattern.MatchString(line) ||
+		headingPattern.MatchString(line) ||
+		dividerPattern.MatchString(line) ||
+		listPattern.MatchString(line) ||
+		quotePattern.MatchString(line)
+}
+
+// parseList collects the items of a list including nested ones, continuation
+// lines and blank lines between items. Returns the index of the first line
+// after the list.
+func parseList(lines []string, i int, node *node) int {
+	// indentation of the open levels
+	var indents []int
+
+	for i < len(lines) {
+		line := lines[i]
+
+		if strings.TrimSpace(line) == "" {
+			// a blank line ends the list unless an item follows
+			j := i + 1
+			for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+				j++
+			}
+
+			if j == len(lines) || !listPattern.MatchString(lines[j]) {
+				return j
+			}
+
+			i = j
+			continue
+		}
+
+		match := listPattern.FindStringSubmatch(line)
+		if match == nil {
+			// lazy continuation of the previous item
+			if len(node.items) == 0 || startsBlock(lines, i) || strings.Contains(line, "|") && i+1 < len(lines) && separatorPattern.MatchString(lines[i+1]) {
+				return i
+			}
+
+			node.items[len(node.items)-1].text += " " + strings.TrimSpace(line)
+			i++
+			continue
+		}
+
+		indent := width(match[1])
+		for len(indents) > 0 && indent < indents[len(indents)-1] {
+			indents = indents[:len(indents)-1]
+		}
+
+		if len(indents) == 0 || indent > indents[len(indents)-1] {
+			indents = append(indents, indent)
+		}
+
+		_, err := strconv.Atoi(strings.TrimRight(match[2], ".)"))
+
+		node.items = append(node.items, item{
+			// Slack indents up to 8 levels
+			indent:  min(len(indents)-1, 8),
+			ordered: err == nil,
+			text:    match[3],
+		})
+		i++
+	}
+
+	return i
+}
+
+// tabs count as 4 spaces
+func width(indentation string) int {
+	return len(strings.ReplaceAll(indentation, "\t", "    "))
+}
+
+// Blocks renders the Markdown as at most maxBlocks blocks, every one within
+// Slack's limits. If that needs more blocks, the text is rendered as mrkdwn
+// sections instead, at the cost of lists and tables. Text beyond even that is
+// cut off and TRUNCATED_MESSAGE added.
+func Blocks(markdown string, maxBlocks int) []I {
+	var blocks []I
+	var text []string
+
+	// consecutive paragraphs share a section, as a message can only hold 50
+	// blocks
+	flush := func() {
+		if len(text) > 0 {
+			blocks = append(blocks, sections(strings.Join(text, "\n\n"))...)
+			text = nil
+		}
+	}
+
+	for _, node := range parse(markdown) {
+		switch node.kind {
+		case paragraph, quote:
+			text = append(text, renderText(node))
+			continue
+		}
+
+		flush()
+
+		switch node.kind {
+		case heading:
+			// Slack rejects empty headers
+			if text := strings.TrimSpace(plain(parseInline(node.lines[0]))); text != "" {
+				blocks = append(blocks, I{"type": "header", "text": I{"type": "plain_text", "text": truncate(text, MaxHeaderText), "emoji": true}})
+			}
+		case divider:
+			blocks = append(blocks, I{"type": "divider"})
+		case code:
+			blocks = append(blocks, preformatted(strings.Join(node.lines, "\n"))...)
+		case table:
+			blocks = append(blocks, preformatted(renderTable(node.lines))...)
+		case list:
+			blocks = append(blocks, I{"type": "rich_text", "elements": renderList(node.items)})
+		}
+	}
+
+	flush()
+
+	if len(blocks) <= maxBlocks {
+		return blocks
+	}
+
+	blocks = sections(Text(markdown))
+	if len(blocks) > maxBlocks {
+		blocks = append(blocks[:maxBlocks-1], I{"type": "context", "elements": []I{{"type": "mrkdwn", "text": TRUNCATED_MESSAGE}}})
+	}
+
+	return blocks
+}
+
+// Text renders the Markdown as mrkdwn, e.g. for the text of a message.
+// https://api.slack.com/reference/surfaces/formatting
+func Text(markdown string) string {
+	var parts []string
+
+	for _, node := range parse(markdown) {
+		switch node.kind {
+		case paragraph, quote:
+			parts = append(parts, renderText(node))
+		case heading:
+			parts = append(parts, mrkdwn([]span{{text: plain(parseInline(node.lines[0])), bold: true}}))
+		case divider:
+			parts = append(parts, "───")
+		case code:
+			parts = append(parts, "```\n"+escaper.Replace(strings.Join(node.lines, "\n"))+"\n```")
+		case table:
+			parts = append(parts, "```\n"+escaper.Replace(renderTable(node.lines))+"\n```")
+		case list:
+			var lines []string
+			numbers := map[int]int{}
+
+			for _, item := range node.items {
+				for indent := range numbers {
+					if indent > item.indent {
+						delete(numbers, indent)
+					}
+				}
+
+				bullet := "•"
+				if item.ordered {
+					numbers[item.indent]++
+					bullet = strconv.Itoa(numbers[item.indent]) + "."
+				}
+
+				lines = append(lines, strings.Repeat("    ", item.indent)+bullet+" "+mrkdwn(parseInline(item.text)))
+			}
+
+			parts = append(parts, strings.Join(lines, "\n"))
+		}
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+func renderText(node node) string {
+	text := mrkdwn(parseInline(strings.Join(node.lines, "\n")))
+
+	if node.kind == quote {
+		text = "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	}
+
+	return text
+}
+
+// sections splits mrkdwn into section blocks of at most MaxSectionText
+func sections(text string) []I {
+	var blocks []I
+
+	for _, chunk := range split(text, MaxSectionText) {
+		blocks = append(blocks, I{"type": "section", "text": I{"type": "mrkdwn", "text": chunk}})
+	}
+
+	return blocks
+}
+
+// https://api.slack.com/reference/block-kit/blocks#rich_text_preformatted
+func preformatted(text string) []I {
+	var blocks []I
+
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	for _, chunk := range split(text, MaxSectionText) {
+		blocks = append(blocks, I{"type": "rich_text", "elements": []I{{
+			"type":     "rich_text_preformatted",
+			"elements": []I{{"type": "text", "text": chunk}},
+		}}})
+	}
+
+	return blocks
+}
+
+// renderList groups consecutive items of the same level and style into
+// rich_text_list elements, ordered lists continue their numbering after
+// nested items.
+// https://api.slack.com/reference/block-kit/blocks#rich_text_list
+func renderList(items []item) []I {
+	var elements []I
+	numbers := map[int]int{}
+	last := -1
+
+	for _, item := range items {
+		for indent := range numbers {
+			if indent > item.indent {
+				delete(numbers, indent)
+			}
+		}
+
+		style := "bullet"
+		if item.ordered {
+			style = "ordered"
+		}
+
+		// Slack rejects empty sections
+		text := richText(parseInline(item.text))
+		if len(text) == 0 {
+			text = []I{{"type": "text", "text": " "}}
+		}
+
+		section := I{"type": "rich_text_section", "elements": text}
+
+		if last >= 0 && elements[last]["indent"] == item.indent && elements[last]["style"] == style {
+			elements[last]["elements"] = append(elements[last]["elements"].([]I), section)
+		} else {
+			element := I{"type": "rich_text_list", "style": style, "indent": item.indent, "elements": []I{section}}
+			if item.ordered && numbers[item.indent] > 0 {
+				element["offset"] = numbers[item.indent]
+			}
+
+			elements = append(elements, element)
+			last = len(elements) - 1
+		}
+
+		if item.ordered {
+			numbers[item.indent]++
+		}
+	}
+
+	return elements
+}
+
+// renderTable aligns the cells, Slack has no tables
+func renderTable(lines []string) string {
+	var rows [][]string
+	var widths []int
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+
+		var row []string
+		for i, cell := range strings.Split(line, "|") {
+			cell = plain(parseInline(strings.TrimSpace(cell)))
+			row = append(row, cell)
+
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+
+		rows = append(rows, row)
+	}
+
+	var b strings.Builder
+
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		var cells []string
+		for j, cell := range row {
+			cells = append(cells, cell+strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell)))
+		}
+		b.WriteString(strings.TrimRight(strings.Join(cells, " | "), " "))
+
+		// header separator
+		if i == 0 && len(rows) > 1 {
+			var dashes []string
+			for _, width := range widths[:len(row)] {
+				dashes = append(dashes, strings.Repeat("-", width))
+			}
+			b.WriteString("\n" + strings.Join(dashes, "-|-"))
+		}
+	}
+
+	return b.String()
+}
+
+// split cuts text into chunks of at most size bytes, preferably at line
+// breaks, then at spaces. Slack counts characters, so bytes are on the safe
+// side.
+func split(text string, size int) []string {
+	var chunks []string
+
+	for len(text) > size {
+		cut := strings.LastIndex(text[:size], "\n")
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:size], " ")
+		}
+		if cut <= 0 {
+			cut = size
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+
+		chunks = append(chunks, text[:cut])
+
+		// drop the line break or space cut at, but keep the indentation of
+		// the next line
+		if text[cut] == '\n' || text[cut] == ' ' {
+			cut++
+		}
+		text = strings.TrimLeft(text[cut:], "\n")
+	}
+
+	if strings.TrimSpace(text) != "" {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+func truncate(text string, size int) string {
+	if utf8.RuneCountInString(text) <= size {
+		return text
+	}
+
+	runes := []rune(text)
+
+	return string(runes[:size-1]) + "…"
+}
@@ -0,0 +1,284 @@
+package blockkit_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dominikwinter/slackgpt/internal/blockkit"
+)
+
+type I = blockkit.I
+
+func section(text string) I {
+	return I{"type": "section", "text": I{"type": "mrkdwn", "text": text}}
+}
+
+func header(text string) I {
+	return I{"type": "header", "text": I{"type": "plain_text", "text": text, "emoji": true}}
+}
+
+func preformatted(text string) I {
+	return I{"type": "rich_text", "elements": []I{{
+		"type":     "rich_text_preformatted",
+		"elements": []I{{"type": "text", "text": text}},
+	}}}
+}
+
+func list(style string, indent int, items ...string) I {
+	var sections []I
+	for _, item := range items {
+		sections = append(sections, I{"type": "rich_text_section", "elements": []I{{"type": "text", "text": item}}})
+	}
+
+	return I{"type": "rich_text_list", "style": style, "indent": indent, "elements": sections}
+}
+
+func TestBlocks(t *testing.T) {
+	for name, test := range map[string]struct {
+		markdown string
+		want     []I
+	}{
+		"heading": {
+			"# Title #",
+			[]I{header("Title")},
+		},
+		"heading without formatting": {
+			"## Feedback for **Jane**",
+			[]I{header("Feedback for Jane")},
+		},
+		"long heading": {
+			"# " + strings.Repeat("a", 200),
+			[]I{header(strings.Repeat("a", 149) + "…")},
+		},
+		"empty heading": {
+			"#",
+			[]I{section("#")},
+		},
+		"emphasis": {
+			"Hello **bold** and *italic*, _under_ ~~gone~~",
+			[]I{section("Hello *bold* and _italic_, _under_ ~gone~")},
+		},
+		"underscores within words": {
+			"snake_case_name stays",
+			[]I{section("snake_case_name stays")},
+		},
+		"unclosed markers": {
+			"2 * 3 and **open",
+			[]I{section("2 * 3 and **open")},
+		},
+		"escaping": {
+			"Tom & Jerry <script>",
+			[]I{section("Tom &amp; Jerry &lt;script&gt;")},
+		},
+		"code span": {
+			"Use `a < b && c` or `*x*`",
+			[]I{section("Use `a &lt; b &amp;&amp; c` or `*x*`")},
+		},
+		"links": {
+			`See [the docs](https://example.com "Docs") and ![logo](https://example.com/logo.png)`,
+			[]I{section("See <https://example.com|the docs> and <https://example.com/logo.png|logo>")},
+		},
+		"link label is escaped": {
+			"[a < b](https://example.com)",
+			[]I{section("<https://example.com|a &lt; b>")},
+		},
+		"slack markup": {
+			"ping <@U123> in <#C123|general>, <!here> <https://slack.com|Slack>",
+			[]I{section("ping <@U123> in <#C123|general>, <!here> <https://slack.com|Slack>")},
+		},
+		"paragraphs share a section": {
+			"one\ntwo\n\nthree",
+			[]I{section("one\ntwo\n\nthree")},
+		},
+		"quote": {
+			"> quoted\n> lines",
+			[]I{section("> quoted\n> lines")},
+		},
+		"divider": {
+			"text\n\n---\n\nmore",
+			[]I{section("text"), {"type": "divider"}, section("more")},
+		},
+		"bullet list": {
+			"- one\n* two\n  - nested\n- three",
+			[]I{{"type": "rich_text", "elements": []I{
+				list("bullet", 0, "one", "two"),
+				list("bullet", 1, "nested"),
+				list("bullet", 0, "three"),
+			}}},
+		},
+		"ordered list continues after nested items": {
+			"1. first\n2. second\n   - sub\n3. third",
+			[]I{{"type": "rich_text", "elements": []I{
+				list("ordered", 0, "first", "second"),
+				list("bullet", 1, "sub"),
+				func() I { l := list("ordered", 0, "third"); l["offset"] = 2; return l }(),
+			}}},
+		},
+		"list item continuation": {
+			"- one\n  continued\n\n- two\n\nafter",
+			[]I{{"type": "rich_text", "elements": []I{list("bullet", 0, "one continued", "two")}}, section("after")},
+		},
+		"list item formatting": {
+			"- **bold** <@U123>",
+			[]I{{"type": "rich_text", "elements": []I{{"type": "rich_text_list", "style": "bullet", "indent": 0, "elements": []I{{
+				"type": "rich_text_section",
+				"elements": []I{
+					{"type": "text", "text": "bold", "style": I{"bold": true}},
+					{"type": "text", "text": " "},
+					{"type": "user", "user_id": "U123"},
+				},
+			}}}}}},
+		},
+		"code keeps indentation and isn't escaped": {
+			"```go\nfunc main() {\n\tif x < 1 {\n\t\treturn\n\t}\n}\n```",
+			[]I{preformatted("func main() {\n\tif x < 1 {\n\t\treturn\n\t}\n}")},
+		},
+		"unclosed code": {
+			"```\ncode",
+			[]I{preformatted("code")},
+		},
+		"table": {
+			"| name | score |\n|---|:-:|\n| **Jane** | 9 |",
+			[]I{preformatted("name | score\n-----|------\nJane | 9")},
+		},
+		"paragraph interrupted by a list": {
+			"Steps:\n- one",
+			[]I{section("Steps:"), {"type": "rich_text", "elements": []I{list("bullet", 0, "one")}}},
+		},
+		"empty": {
+			"  \n\n",
+			nil,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if blocks := blockkit.Blocks(test.markdown, blockkit.MaxBlocks); !reflect.DeepEqual(blocks, test.want) {
+				t.Fatalf("expected\n%v\ngot\n%v", test.want, blocks)
+			}
+		})
+	}
+}
+
+func TestText(t *testing.T) {
+	for name, test := range map[string]struct {
+		markdown string
+		want     string
+	}{
+		"heading":   {"## Feedback for **Jane**", "*Feedback for Jane*"},
+		"emphasis":  {"**bold** and *italic*", "*bold* and _italic_"},
+		"escaping":  {"Tom & Jerry <script>", "Tom &amp; Jerry &lt;script&gt;"},
+		"code span": {"`a < b`", "`a &lt; b`"},
+		"code":      {"```\nif a < b {\n    return\n}\n```", "```\nif a &lt; b {\n    return\n}\n```"},
+		"link":      {"[docs](https://example.com)", "<https://example.com|docs>"},
+		"list":      {"1. first\n2. second\n   - sub\n3. third", "1. first\n2. second\n    • sub\n3. third"},
+		"table":     {"| a | b |\n|---|---|\n| 1 | 22 |", "```\na | b\n--|---\n1 | 22\n```"},
+		"divider":   {"one\n\n***\n\ntwo", "one\n\n───\n\ntwo"},
+		"mention":   {"Hi <@U123>", "Hi <@U123>"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if text := blockkit.Text(test.markdown); text != test.want {
+				t.Fatalf("expected %q, got %q", test.want, text)
+			}
+		})
+	}
+}
+
+// text of section and preformatted blocks
+func content(block I) string {
+	if block["type"] == "section" {
+		return block["text"].(I)["text"].(string)
+	}
+
+	return block["elements"].([]I)[0]["elements"].([]I)[0]["text"].(string)
+}
+
+func TestLongParagraphIsSplitAtLineBreaks(t *testing.T) {
+	line := strings.Repeat("word ", 99) + "end"
+	lines := make([]string, 20)
+	for i := range lines {
+		lines[i] = line
+	}
+
+	blocks := blockkit.Blocks(strings.Join(lines, "\n"), blockkit.MaxBlocks)
+	if len(blocks) < 2 {
+		t.Fatalf("expected several sections, got %d", len(blocks))
+	}
+
+	var chunks []string
+	for _, block := range blocks {
+		text := content(block)
+		if len(text) > blockkit.MaxSectionText {
+			t.Fatalf("section exceeds %d characters: %d", blockkit.MaxSectionText, len(text))
+		}
+
+		chunks = append(chunks, text)
+	}
+
+	if joined := strings.Join(chunks, "\n"); joined != strings.Join(lines, "\n") {
+		t.Fatal("expected the sections to hold the whole text")
+	}
+}
+
+func TestLongLineIsSplitAtSpaces(t *testing.T) {
+	text := strings.TrimSpace(strings.Repeat("word ", 1000))
+
+	blocks := blockkit.Blocks(text, blockkit.MaxBlocks)
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 sections, got %d", len(blocks))
+	}
+
+	first, second := content(blocks[0]), content(blocks[1])
+	if strings.HasSuffix(first, " ") || strings.HasPrefix(second, " ") || first+" "+second != text {
+		t.Fatalf("expected to be cut at a space, got %q and %q", first[len(first)-10:], second[:10])
+	}
+}
+
+func TestLongCodeKeepsIndentation(t *testing.T) {
+	var lines []string
+	for i := 0; len(strings.Join(lines, "\n")) < 2*blockkit.MaxSectionText; i++ {
+		lines = append(lines, "    x := "+strconv.Itoa(i))
+	}
+
+	blocks := blockkit.Blocks("```\n"+strings.Join(lines, "\n")+"\n```", blockkit.MaxBlocks)
+	if len(blocks) < 2 {
+		t.Fatalf("expected several blocks, got %d", len(blocks))
+	}
+
+	var chunks []string
+	for _, block := range blocks {
+		chunks = append(chunks, content(block))
+	}
+
+	if joined := strings.Join(chunks, "\n"); joined != strings.Join(lines, "\n") {
+		t.Fatalf("expected the indentation to be kept, got %q", chunks[1][:20])
+	}
+}
+
+func TestTooManyBlocksFallBackToSections(t *testing.T) {
+	markdown := strings.Repeat("# Heading\n\nText\n\n", 30)
+
+	blocks := blockkit.Blocks(markdown, 10)
+	if len(blocks) != 1 || blocks[0]["type"] != "section" {
+		t.Fatalf("expected a single section, got %v", blocks)
+	}
+
+	if text := content(blocks[0]); !strings.HasPrefix(text, "*Heading*\n\nText") {
+		t.Fatalf("unexpected text %q", text)
+	}
+}
+
+func TestTooLongTextIsTruncatedVisibly(t *testing.T) {
+	paragraph := strings.Repeat("word ", 500)
+	markdown := strings.Repeat(paragraph+"\n\n", 20)
+
+	blocks := blockkit.Blocks(markdown, 3)
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+
+	marker := I{"type": "context", "elements": []I{{"type": "mrkdwn", "text": blockkit.TRUNCATED_MESSAGE}}}
+	if !reflect.DeepEqual(blocks[2], marker) {
+		t.Fatalf("expected the truncation to be marked, got %v", blocks[2])
+	}
+}
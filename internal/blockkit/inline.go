@@ -0,0 +1,284 @@
+package blockkit
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// span is a run of text with the same formatting
+type span struct {
+	text   string
+	url    string
+	bold   bool
+	italic bool
+	strike bool
+	code   bool
+	// Slack markup like <@U123> or <#C123|general>, passed on as is
+	markup string
+}
+
+var (
+	// [label](url "title") and ![alt](url)
+	linkPattern = regexp.MustCompile(`^!?\[([^\]]*)\]\(\s*<?([^)\s>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	// <@U123>, <#C123|general>, <!here>, <https://example.com|label>
+	// https://api.slack.com/reference/surfaces/formatting#advanced
+	markupPattern = regexp.MustCompile(`^<([@#!][^<>\s]+|(?:https?|mailto):[^<>\s]+)>`)
+)
+
+// parseInline splits CommonMark inline content into spans. Unclosed markers
+// are kept as text.
+func parseInline(s string) []span {
+	var spans []span
+	var text strings.Builder
+	var style span
+
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, span{text: text.String(), bold: style.bold, italic: style.italic, strike: style.strike})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.ContainsRune("\\`*_~[]()#+-.!<>|", rune(rest[1])):
+			text.WriteByte(rest[1])
+			i += 2
+
+		case rest[0] == '`':
+			ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+			end := strings.Index(rest[ticks:], rest[:ticks])
+			if end < 0 {
+				text.WriteString(rest[:ticks])
+				i += ticks
+				continue
+			}
+
+			flush()
+			spans = append(spans, span{text: strings.TrimSpace(rest[ticks : ticks+end]), code: true})
+			i += 2*ticks + end
+
+		case rest[0] == '[' || strings.HasPrefix(rest, "!["):
+			match := linkPattern.FindStringSubmatch(rest)
+			if match == nil {
+				text.WriteByte(rest[0])
+				i++
+				continue
+			}
+
+			flush()
+			label := plain(parseInline(match[1]))
+			if label == "" {
+				label = match[2]
+			}
+			spans = append(spans, span{text: label, url: match[2], bold: style.bold, italic: style.italic, strike: style.strike})
+			i += len(match[0])
+
+		case rest[0] == '<':
+			match := markupPattern.FindStringSubmatch(rest)
+			if match == nil {
+				text.WriteByte('<')
+				i++
+				continue
+			}
+
+			flush()
+			spans = append(spans, span{markup: match[1]})
+			i += len(match[0])
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if !style.bold && !closes(s, i, rest[:2]) {
+				text.WriteString(rest[:2])
+				i += 2
+				continue
+			}
+
+			flush()
+			style.bold = !style.bold
+			i += 2
+
+		case strings.HasPrefix(rest, "~~"):
+			if !style.strike && !strings.Contains(rest[2:], "~~") {
+				text.WriteString("~~")
+				i += 2
+				continue
+			}
+
+			flush()
+			style.strike = !style.strike
+			i += 2
+
+		case rest[0] == '*' || rest[0] == '_':
+			if !style.italic && !closes(s, i, rest[:1]) || rest[0] == '_' && !wordBoundary(s, i) {
+				text.WriteByte(rest[0])
+				i++
+				continue
+			}
+
+			flush()
+			style.italic = !style.italic
+			i++
+
+		default:
+			_, size := utf8.DecodeRuneInString(rest)
+			text.WriteString(rest[:size])
+			i += size
+		}
+	}
+
+	flush()
+
+	return spans
+}
+
+// closes reports whether the marker at i opens emphasis, it must be followed
+// by a non-space and closed later on
+func closes(s string, i int, marker string) bool {
+	rest := s[i+len(marker):]
+	if rest == "" || rest[0] == ' ' {
+		return false
+	}
+
+	return strings.Contains(rest, marker)
+}
+
+// underscores within words like snake_case are no emphasis
+func wordBoundary(s string, i int) bool {
+	before, _ := utf8.DecodeLastRuneInString(s[:i])
+	after, _ := utf8.DecodeRuneInString(s[i+1:])
+
+	return i == 0 || i+1 == len(s) || !isWord(before) || !isWord(after)
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// plain returns the text without formatting, links keep their label
+func plain(spans []span) string {
+	var b strings.Builder
+
+	for _, span := range spans {
+		if span.markup != "" {
+			b.WriteString(markupLabel(span.markup))
+			continue
+		}
+
+		b.WriteString(span.text)
+	}
+
+	return b.String()
+}
+
+// markupLabel is the visible part of Slack markup, ids can't be resolved here
+func markupLabel(markup string) string {
+	if i := strings.IndexByte(markup, '|'); i >= 0 {
+		return markup[i+1:]
+	}
+
+	return markup
+}
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// mrkdwn renders the spans in Slack's markup
+// https://api.slack.com/reference/surfaces/formatting#basic-formatting
+func mrkdwn(spans []span) string {
+	var b strings.Builder
+
+	for _, span := range spans {
+		switch {
+		case span.markup != "":
+			b.WriteString("<" + span.markup + ">")
+		case span.code:
+			b.WriteString("`" + escaper.Replace(span.text) + "`")
+		case span.url != "":
+			b.WriteString(wrap(span, "<"+span.url+"|"+escaper.Replace(span.text)+">"))
+		default:
+			b.WriteString(wrap(span, escaper.Replace(span.text)))
+		}
+	}
+
+	return b.String()
+}
+
+// wrap adds the formatting markers, spaces stay outside as Slack ignores
+// markers next to them
+func wrap(span span, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+
+	if span.strike {
+		trimmed = "~" + trimmed + "~"
+	}
+	if span.italic {
+		trimmed = "_" + trimmed + "_"
+	}
+	if span.bold {
+		trimmed = "*" + trimmed + "*"
+	}
+
+	return lead + trimmed + trail
+}
+
+// richText renders the spans as elements of a rich_text_section
+// https://api.slack.com/reference/block-kit/blocks#rich_text_section
+func richText(spans []span) []I {
+	elements := []I{}
+
+	for _, span := range spans {
+		if span.markup != "" {
+			elements = append(elements, markupElement(span.markup))
+			continue
+		}
+
+		element := I{"type": "text", "text": span.text}
+		if span.url != "" {
+			element = I{"type": "link", "url": span.url, "text": span.text}
+		}
+
+		style := I{}
+		for name, set := range map[string]bool{"bold": span.bold, "italic": span.italic, "strike": span.strike, "code": span.code} {
+			if set {
+				style[name] = true
+			}
+		}
+
+		if len(style) > 0 {
+			element["style"] = style
+		}
+
+		elements = append(elements, element)
+	}
+
+	return elements
+}
+
+// markupElement turns mentions and links into their rich text elements
+func markupElement(markup string) I {
+	id, label, _ := strings.Cut(markup, "|")
+
+	switch {
+	case strings.HasPrefix(id, "@"):
+		return I{"type": "user", "user_id": id[1:]}
+	case strings.HasPrefix(id, "#"):
+		return I{"type": "channel", "channel_id": id[1:]}
+	case id == "!here" || id == "!channel" || id == "!everyone":
+		return I{"type": "broadcast", "range": id[1:]}
+	case strings.HasPrefix(id, "!"):
+		return I{"type": "text", "text": markupLabel(markup)}
+	case label != "":
+		return I{"type": "link", "url": id, "text": label}
+	default:
+		return I{"type": "link", "url": id}
+	}
+}
@@ -0,0 +1,191 @@
+// Package chat answers with the Chat Completions API. Unlike the Assistants
+// API it is stateless, so the provider keeps the conversation itself and
+// sends it with every message.
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/store"
+)
+
+// a model calling tools forever must not run up the bill
+const maxToolRounds = 10
+
+var ErrFilesNotSupported = errors.New("files are not supported by the chat completions API")
+
+// Provider implements the same methods as openai.Client on top of
+// openai.Client.CreateChatCompletion.
+type Provider struct {
+	Client       *openai.Client
+	Model        string
+	Instructions string
+	// conversations by thread id
+	History store.HistoryStore
+	// only the latest MaxMessages are sent, 0 sends all
+	MaxMessages int
+	// reads the conversation from Slack instead of History for messages sent
+	// with ContextWithSlackThread, optional
+	Slack *SlackHistory
+}
+
+// CreateThread only creates an id, the conversation starts with its first
+// message. The prefix matches OpenAI's thread ids, so the router can recover
+// it from Slack the same way.
+func (p *Provider) CreateThread(ctx context.Context) (*openai.Thread, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &openai.Thread{Id: "thread_" + hex.EncodeToString(id)}, nil
+}
+
+func (p *Provider) SendMessageAndWaitForAnswer(ctx context.Context, threadId, content string, attachments ...openai.Attachment) (*openai.Answer, error) {
+	return p.send(ctx, threadId, content, func(messages []openai.ChatMessage) (*openai.ChatCompletion, error) {
+		return p.Client.CreateChatCompletion(ctx, p.Model, messages)
+	})
+}
+
+// same as SendMessageAndWaitForAnswer, but the answer is passed to onDelta
+// while it is generated
+func (p *Provider) SendMessageAndStreamAnswer(ctx context.Context, threadId, content string, onDelta func(text string), attachments ...openai.Attachment) (*openai.Answer, error) {
+	return p.send(ctx, threadId, content, func(messages []openai.ChatMessage) (*openai.ChatCompletion, error) {
+		return p.Client.CreateChatCompletionStream(ctx, p.Model, messages, onDelta)
+	})
+}
+
+// UploadFile fails, there is no file_search without assistants.
+func (p *Provider) UploadFile(ctx context.Context, purpose, fileName string, file io.Reader) (*openai.File, error) {
+	return nil, ErrFilesNotSupported
+}
+
+// send completes the conversation with the new message, executing tool calls
+// until the model answers. The conversation is only stored with the answer,
+// so a failed message can simply be sent again. Conversations read from Slack
+// aren't stored at all, the answer becomes part of the thread.
+func (p *Provider) send(ctx context.Context, threadId, content string, complete func(messages []openai.ChatMessage) (*openai.ChatCompletion, error)) (*openai.Answer, error) {
+	thread, fromSlack := slackThreadFromContext(ctx)
+	fromSlack = fromSlack && p.Slack != nil
+
+	var history []openai.ChatMessage
+	var err error
+
+	if fromSlack {
+		history, err = p.Slack.Messages(ctx, thread)
+	} else {
+		history, err = p.history(threadId)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+
+	added := []openai.ChatMessage{{Role: "user", Content: content}}
+	answer := &openai.Answer{}
+
+	for round := 0; ; round++ {
+		completion, err := complete(p.prompt(append(history, added...)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create chat completion: %w", err)
+		}
+
+		if len(completion.Choices) == 0 {
+			return nil, fmt.Errorf("failed to get response from OpenAI: no choices")
+		}
+
+		answer.Model = completion.Model
+		if completion.Usage != nil {
+			answer.Usage.PromptTokens += completion.Usage.PromptTokens
+			answer.Usage.CompletionTokens += completion.Usage.CompletionTokens
+			answer.Usage.TotalTokens += completion.Usage.TotalTokens
+		}
+
+		message := completion.Choices[0].Message
+		added = append(added, message)
+
+		if len(message.ToolCalls) == 0 {
+			answer.Text = message.Text()
+			break
+		}
+
+		if round >= maxToolRounds {
+			return nil, fmt.Errorf("failed to get response from OpenAI: more than %d rounds of tool calls", maxToolRounds)
+		}
+
+		for _, output := range p.Client.Tools.Execute(ctx, message.ToolCalls) {
+			added = append(added, openai.ChatMessage{Role: "tool", ToolCallId: output.ToolCallId, Content: output.Output})
+		}
+	}
+
+	if answer.Text == "" {
+		return nil, fmt.Errorf("failed to get response from OpenAI: no messages")
+	}
+
+	if fromSlack {
+		return answer, nil
+	}
+
+	if err := p.append(threadId, added); err != nil {
+		return nil, fmt.Errorf("failed to store history: %w", err)
+	}
+
+	return answer, nil
+}
+
+// prompt puts the instructions in front of the latest MaxMessages. The
+// conversation is cut before a user message, tool results without their call
+// are rejected by the API.
+func (p *Provider) prompt(messages []openai.ChatMessage) []openai.ChatMessage {
+	if p.MaxMessages > 0 && len(messages) > p.MaxMessages {
+		messages = messages[len(messages)-p.MaxMessages:]
+
+		for len(messages) > 1 && messages[0].Role != "user" {
+			messages = messages[1:]
+		}
+	}
+
+	prompt := make([]openai.ChatMessage, 0, len(messages)+1)
+
+	if p.Instructions != "" {
+		prompt = append(prompt, openai.ChatMessage{Role: "system", Content: p.Instructions})
+	}
+
+	return append(prompt, messages...)
+}
+
+func (p *Provider) history(threadId string) ([]openai.ChatMessage, error) {
+	raw, err := p.History.GetHistory(threadId)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]openai.ChatMessage, len(raw))
+	for i, message := range raw {
+		if err := json.Unmarshal(message, &messages[i]); err != nil {
+			return nil, fmt.Errorf("failed to decode message: %w", err)
+		}
+	}
+
+	return messages, nil
+}
+
+func (p *Provider) append(threadId string, messages []openai.ChatMessage) error {
+	raw := make([]json.RawMessage, len(messages))
+	for i, message := range messages {
+		b, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+
+		raw[i] = b
+	}
+
+	return p.History.AppendHistory(threadId, raw...)
+}
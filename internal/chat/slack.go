@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+)
+
+// SlackAPI is the part of slack.Client the history reader uses.
+type SlackAPI interface {
+	GetThread(ctx context.Context, channel, threadTs string) ([]slack.Message, error)
+	GetUserInfo(ctx context.Context, user string) (*slack.UserInfo, error)
+}
+
+// SlackThread is the Slack thread a message is sent in, Ts is the message
+// itself.
+type SlackThread struct {
+	Channel  string
+	ThreadTs string
+	Ts       string
+	// the bot's user in the workspace, empty takes every bot for this one
+	BotUserId string
+}
+
+type slackThreadKey struct{}
+
+// ContextWithSlackThread lets the provider read the conversation from the
+// thread, see SlackHistory.
+func ContextWithSlackThread(ctx context.Context, thread SlackThread) context.Context {
+	return context.WithValue(ctx, slackThreadKey{}, thread)
+}
+
+func slackThreadFromContext(ctx context.Context) (SlackThread, bool) {
+	thread, ok := ctx.Value(slackThreadKey{}).(SlackThread)
+	return thread, ok
+}
+
+// <@U123>, <@U123|name>, <#C123|general>, <!here>, <https://example.com|label>
+// https://api.slack.com/reference/surfaces/formatting#retrieving-messages
+var mentionPattern = regexp.MustCompile(`<([@#!]?)([^>|]+)(?:\|([^>]*))?>`)
+
+// SlackHistory reconstructs the conversation from the Slack thread. Messages
+// of this bot become assistant messages, the others user messages, prefixed
+// with the author if several users or bots take part.
+type SlackHistory struct {
+	Slack SlackAPI
+	// older messages are dropped beyond, estimated with 4 characters per
+	// token, 0 keeps all
+	MaxTokens int
+	// texts the bot posts besides answers, e.g. error messages, they are left
+	// out
+	Skip []string
+}
+
+// Messages returns the messages of the thread before thread.Ts, oldest first.
+// The conversation starts with a user message.
+func (h *SlackHistory) Messages(ctx context.Context, thread SlackThread) ([]openai.ChatMessage, error) {
+	replies, err := h.Slack.GetThread(ctx, thread.Channel, thread.ThreadTs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %w", err)
+	}
+
+	names := map[string]string{}
+	users := map[string]bool{}
+
+	for _, reply := range replies {
+		if !isBot(reply, thread.BotUserId) && author(reply) != "" {
+			users[author(reply)] = true
+		}
+	}
+
+	var messages []openai.ChatMessage
+
+	for _, reply := range replies {
+		if !tsBefore(reply.Ts, thread.Ts) {
+			break
+		}
+
+		bot := isBot(reply, thread.BotUserId)
+		if bot && slices.Contains(h.Skip, reply.Text) {
+			continue
+		}
+
+		text := strings.TrimSpace(h.resolveMentions(ctx, reply.Text, names))
+		if text == "" {
+			continue
+		}
+
+		if bot {
+			messages = append(messages, openai.ChatMessage{Role: "assistant", Content: text})
+			continue
+		}
+
+		if len(users) > 1 {
+			text = "@" + h.userName(ctx, author(reply), names) + ": " + text
+		}
+
+		messages = append(messages, openai.ChatMessage{Role: "user", Content: text})
+	}
+
+	return h.trim(messages), nil
+}
+
+// isBot tells if the message is of this bot, other bots take part like users
+func isBot(message slack.Message, botUserId string) bool {
+	if botUserId == "" {
+		return message.BotId != ""
+	}
+
+	return message.User == botUserId
+}
+
+// author of the message, bots may post without a user
+func author(message slack.Message) string {
+	if message.User != "" {
+		return message.User
+	}
+
+	return message.BotId
+}
+
+// trim keeps the latest messages within MaxTokens, but at least the last one.
+func (h *SlackHistory) trim(messages []openai.ChatMessage) []openai.ChatMessage {
+	if h.MaxTokens > 0 {
+		tokens := 0
+
+		for i := len(messages) - 1; i >= 0; i-- {
+			tokens += estimateTokens(messages[i].Text())
+
+			if tokens > h.MaxTokens && i < len(messages)-1 {
+				messages = messages[i+1:]
+				break
+			}
+		}
+	}
+
+	for len(messages) > 0 && messages[0].Role != "user" {
+		messages = messages[1:]
+	}
+
+	return messages
+}
+
+// resolveMentions replaces the Slack markup with what users see, e.g.
+// <@U123> with @Jane Doe.
+func (h *SlackHistory) resolveMentions(ctx context.Context, text string, names map[string]string) string {
+	return mentionPattern.ReplaceAllStringFunc(text, func(mention string) string {
+		match := mentionPattern.FindStringSubmatch(mention)
+		kind, id, label := match[1], match[2], match[3]
+
+		switch {
+		case kind == "@":
+			if label != "" {
+				return "@" + label
+			}
+
+			return "@" + h.userName(ctx, id, names)
+		case kind == "#":
+			if label != "" {
+				return "#" + label
+			}
+
+			return "#" + id
+		case kind == "!":
+			// <!subteam^S123|@team> carries the handle as label
+			if label != "" {
+				return label
+			}
+
+			return "@" + id
+		case label != "":
+			return label + " (" + id + ")"
+		default:
+			return id
+		}
+	})
+}
+
+// userName looks up the real name, the id is used if that fails
+func (h *SlackHistory) userName(ctx context.Context, user string, names map[string]string) string {
+	if name, ok := names[user]; ok {
+		return name
+	}
+
+	name := user
+
+	if info, err := h.Slack.GetUserInfo(ctx, user); err == nil && info.Ok && info.User != nil {
+		switch {
+		case info.User.RealName != "":
+			name = info.User.RealName
+		case info.User.Name != "":
+			name = info.User.Name
+		}
+	}
+
+	names[user] = name
+
+	return name
+}
+
+// good enough for English, the real count depends on the model's tokenizer
+// https://platform.openai.com/tokenizer
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text)+3)/4 + 4
+}
+
+// tsBefore compares Slack timestamps like 1700000000.000100, an empty b is
+// after everything
+func tsBefore(a, b string) bool {
+	if b == "" {
+		return true
+	}
+
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
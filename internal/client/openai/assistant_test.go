@@ -0,0 +1,38 @@
+package openai_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/testserver"
+)
+
+type I = map[string]interface{}
+
+func TestCreateAssistantSearchesFilesInVectorStore(t *testing.T) {
+	server := testserver.NewOpenAI()
+	t.Cleanup(server.Close)
+
+	client := openai.New(server.URL, "sk-test", "")
+
+	assistant, err := client.CreateAssistant(context.Background(), "Feedback", "Ask questions.", "gpt-4o", []string{"file_1", "file_2"})
+	if err != nil || assistant.Id == "" {
+		t.Fatalf("expected the assistant to be created, got %+v %v", assistant, err)
+	}
+
+	assistants := server.Assistants()
+	if len(assistants) != 1 {
+		t.Fatalf("expected 1 assistant, got %v", assistants)
+	}
+
+	want := I{"file_search": I{"vector_stores": []interface{}{I{"file_ids": []interface{}{"file_1", "file_2"}}}}}
+	if !reflect.DeepEqual(assistants[0]["tool_resources"], want) {
+		t.Fatalf("expected the files in a vector store, got %v", assistants[0]["tool_resources"])
+	}
+
+	if tools := assistants[0]["tools"].([]interface{}); len(tools) != 1 || tools[0].(I)["type"] != "file_search" {
+		t.Fatalf("expected the file_search tool, got %v", tools)
+	}
+}
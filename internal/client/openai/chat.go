@@ -0,0 +1,191 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// https://platform.openai.com/docs/api-reference/chat/create#chat-create-messages
+type ChatMessage struct {
+	Role string `json:"role"`
+	// a string or a list of content parts, nil for assistant messages with
+	// tool calls only
+	Content    interface{} `json:"content"`
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallId string      `json:"tool_call_id,omitempty"`
+}
+
+// Text returns the content of messages with a string content
+func (m ChatMessage) Text() string {
+	text, _ := m.Content.(string)
+	return text
+}
+
+// https://platform.openai.com/docs/api-reference/chat/object
+type ChatCompletion struct {
+	Id      string       `json:"id"`
+	Model   string       `json:"model"`
+	Choices []ChatChoice `json:"choices"`
+	Usage   *Usage       `json:"usage"`
+}
+
+type ChatChoice struct {
+	Index        int         `json:"index"`
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+// https://platform.openai.com/docs/api-reference/chat/streaming
+type ChatCompletionChunk struct {
+	Id      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				Id       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// Create chat completion
+// https://platform.openai.com/docs/api-reference/chat/create
+// all registered Tools are offered as functions, the caller executes them.
+// On Azure model is the deployment.
+func (c *Client) CreateChatCompletion(ctx context.Context, model string, messages []ChatMessage) (res *ChatCompletion, err error) {
+	ctx, cancel := c.Poller.withTimeout(ctx)
+	defer cancel()
+
+	_, err = c.StreamClient.R().
+		SetContext(ctx).
+		SetHeader("Accept", "application/json").
+		SetHeader("Content-Type", "application/json").
+		SetBody(c.chatBody(model, messages, false)).
+		SetSuccessResult(&res).
+		SetPathParam("deployment", model).
+		Post("/v1/chat/completions")
+	return
+}
+
+// Create chat completion with streaming
+// https://platform.openai.com/docs/api-reference/chat/streaming
+// onDelta is called with every chunk of the content, the chunks are merged
+// into the returned completion.
+func (c *Client) CreateChatCompletionStream(ctx context.Context, model string, messages []ChatMessage, onDelta func(text string)) (*ChatCompletion, error) {
+	ctx, cancel := c.Poller.withTimeout(ctx)
+	defer cancel()
+
+	res, err := c.StreamClient.R().
+		SetContext(ctx).
+		SetHeader("Accept", "text/event-stream").
+		SetHeader("Content-Type", "application/json").
+		SetBody(c.chatBody(model, messages, true)).
+		DisableAutoReadResponse().
+		SetPathParam("deployment", model).
+		Post("/v1/chat/completions")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsErrorState() {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("failed to stream chat completion: %s: %s", res.Status, body)
+	}
+
+	completion := &ChatCompletion{Choices: []ChatChoice{{Message: ChatMessage{Role: "assistant"}}}}
+	message := &completion.Choices[0].Message
+
+	var content strings.Builder
+	done := false
+
+	err = readEvents(res.Body, func(event string, data []byte) error {
+		if string(data) == "[DONE]" {
+			done = true
+			return nil
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to decode chunk: %w", err)
+		}
+
+		completion.Id, completion.Model = chunk.Id, chunk.Model
+
+		if chunk.Usage != nil {
+			completion.Usage = chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				content.WriteString(choice.Delta.Content)
+				onDelta(choice.Delta.Content)
+			}
+
+			// the arguments of a call arrive in pieces, the first one carries
+			// the id and name
+			for _, delta := range choice.Delta.ToolCalls {
+				for len(message.ToolCalls) <= delta.Index {
+					message.ToolCalls = append(message.ToolCalls, ToolCall{})
+				}
+
+				call := &message.ToolCalls[delta.Index]
+				call.Id += delta.Id
+				call.Type += delta.Type
+				call.Function.Name += delta.Function.Name
+				call.Function.Arguments += delta.Function.Arguments
+			}
+
+			if choice.FinishReason != "" {
+				completion.Choices[0].FinishReason = choice.FinishReason
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	if !done {
+		return nil, fmt.Errorf("stream ended before completion")
+	}
+
+	if content.Len() > 0 {
+		message.Content = content.String()
+	}
+
+	return completion, nil
+}
+
+func (c *Client) chatBody(model string, messages []ChatMessage, stream bool) I {
+	body := I{"model": model, "messages": messages}
+
+	if definitions := c.Tools.Definitions(); len(definitions) > 0 {
+		body["tools"] = definitions
+	}
+
+	if stream {
+		body["stream"] = true
+		body["stream_options"] = I{"include_usage": true}
+	}
+
+	return body
+}
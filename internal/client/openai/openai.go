@@ -1,13 +1,15 @@
 package openai
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"io"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/dominikwinter/slackgpt/internal/client/helper"
+	"github.com/dominikwinter/slackgpt/internal/config"
 	"github.com/imroc/req/v3"
 )
 
@@ -32,8 +34,46 @@ type Text struct {
 }
 
 type Run struct {
-	Id     string `json:"id"`
-	Status string `json:"status"`
+	Id             string          `json:"id"`
+	Status         string          `json:"status"`
+	Model          string          `json:"model"`
+	RequiredAction *RequiredAction `json:"required_action"`
+	LastError      *RunLastError   `json:"last_error"`
+	Usage          *Usage          `json:"usage"`
+}
+
+// Usage is only set once the run is in a terminal state
+// https://platform.openai.com/docs/api-reference/runs/object#runs/object-usage
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Answer of the assistant with the tokens it cost
+type Answer struct {
+	Text  string
+	Model string
+	Usage Usage
+}
+
+func newAnswer(text string, run *Run) *Answer {
+	answer := &Answer{Text: text}
+
+	if run != nil {
+		answer.Model = run.Model
+
+		if run.Usage != nil {
+			answer.Usage = *run.Usage
+		}
+	}
+
+	return answer
+}
+
+type RunLastError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type Thread struct {
@@ -50,6 +90,43 @@ type File struct {
 	Purpose   string `json:"purpose"`
 }
 
+// Attachment adds a file to a message. Files created with FileSearch are
+// made available to the tools of the thread, images created with ImageFile or
+// ImageUrl become content parts for vision capable models.
+// https://platform.openai.com/docs/api-reference/messages/createMessage#messages-createmessage-attachments
+type Attachment struct {
+	FileId string `json:"file_id"`
+	Tools  []S    `json:"tools"`
+
+	image    bool
+	imageUrl string
+}
+
+// FileSearch attaches the file for the file_search tool
+func FileSearch(fileId string) Attachment {
+	return Attachment{FileId: fileId, Tools: []S{{"type": "file_search"}}}
+}
+
+// ImageFile attaches an image uploaded with purpose "vision"
+func ImageFile(fileId string) Attachment {
+	return Attachment{FileId: fileId, image: true}
+}
+
+// ImageUrl attaches a publicly reachable image
+func ImageUrl(url string) Attachment {
+	return Attachment{imageUrl: url, image: true}
+}
+
+// part returns the content part of an image
+// https://platform.openai.com/docs/api-reference/messages/createMessage#messages-createmessage-content
+func (a Attachment) part() I {
+	if a.imageUrl != "" {
+		return I{"type": "image_url", "image_url": S{"url": a.imageUrl}}
+	}
+
+	return I{"type": "image_file", "image_file": S{"file_id": a.FileId}}
+}
+
 // https://platform.openai.com/docs/api-reference/assistants/object
 type Assistant struct {
 	Id string `json:"id"`
@@ -57,39 +134,128 @@ type Assistant struct {
 
 type Client struct {
 	Client *req.Client
+	// assistant used for runs
+	AssistantId string
+	Poller      Poller
+	// functions the assistant may call, executed when a run requires action
+	Tools *Tools
+	// same as Client, but without timeout as streamed runs and uploads take as
+	// long as they need, they are bounded by their context
+	StreamClient *req.Client
 }
 
+// New creates a client for url, which may be an OpenAI-compatible server like
+// Ollama. token and organization are optional, those servers don't need them.
 func New(url, token, organization string) *Client {
-	if url == "" {
-		panic("url not set")
+	client := newClient(url)
+
+	if token != "" {
+		client.SetCommonBearerAuthToken(token)
+	}
+
+	// https://platform.openai.com/docs/api-reference/organizations-and-projects-optional
+	if organization != "" {
+		client.SetCommonHeader("OpenAI-Organization", organization)
+	}
+
+	return wrap(client)
+}
+
+// NewAzure creates a client for an Azure OpenAI resource, e.g.
+// https://xyz.openai.azure.com. The methods are the same, models are
+// deployment names.
+// https://learn.microsoft.com/en-us/azure/ai-services/openai/reference
+func NewAzure(url, apiKey, apiVersion string) *Client {
+	client := newClient(url).
+		SetCommonHeader("api-key", apiKey).
+		SetCommonQueryParam("api-version", apiVersion).
+		OnBeforeRequest(func(client *req.Client, r *req.Request) error {
+			r.RawURL = azurePath(r.RawURL)
+			return nil
+		})
+
+	return wrap(client)
+}
+
+// NewFromConfig creates an OpenAI or Azure client by cfg.ApiType, with the
+// assistant and run polling of cfg. Tools are up to the caller.
+func NewFromConfig(cfg config.OpenAI) *Client {
+	var client *Client
+	if cfg.ApiType == "azure" {
+		client = NewAzure(cfg.ApiUrl, cfg.ApiKey, cfg.ApiVersion)
+	} else {
+		client = New(cfg.ApiUrl, cfg.ApiKey, cfg.Organization)
+	}
+
+	client.AssistantId = cfg.AssistantId
+	client.Poller.Timeout = cfg.RunTimeout
+	client.Poller.InitialInterval = cfg.RunPollInterval
+	client.Poller.MaxInterval = cfg.RunMaxPollInterval
+
+	return client
+}
+
+// azurePath maps the OpenAI paths to the ones of Azure. Assistants, threads
+// and files only differ in the prefix, chat completions are sent to the
+// deployment of the model.
+func azurePath(path string) string {
+	if !strings.HasPrefix(path, "/v1/") {
+		return path
 	}
 
-	if token == "" {
-		panic("token not set")
+	if path == "/v1/chat/completions" {
+		return "/openai/deployments/{deployment}/chat/completions"
 	}
 
-	if organization == "" {
-		panic("organization not set")
+	return "/openai/" + strings.TrimPrefix(path, "/v1/")
+}
+
+func newClient(url string) *req.Client {
+	if url == "" {
+		panic("url not set")
 	}
 
+	return req.C().
+		// EnableDumpAll().
+		SetBaseURL(url).
+		SetUserAgent("github.com/dominikwinter/slackgpt").
+		SetTimeout(20 * time.Second). // OpenAI API can be slow
+		SetCookieJar(nil).
+		SetCommonErrorResult(&helper.ErrorMessage{}).
+		OnAfterResponse(func(client *req.Client, res *req.Response) error {
+			// turn API errors into errors, so callers never get a nil result
+			// without an error
+			if res.Err == nil && res.IsErrorState() {
+				if msg, ok := res.ErrorResult().(*helper.ErrorMessage); ok {
+					res.Err = fmt.Errorf("%s: %w", res.Status, msg)
+				}
+			}
+
+			return nil
+		})
+}
+
+func wrap(client *req.Client) *Client {
 	return &Client{
-		Client: req.C().
-			// EnableDumpAll().
-			SetBaseURL(url).
-			SetUserAgent("github.com/dominikwinter/slackgpt").
-			SetCommonHeader("OpenAI-Organization", organization).
-			SetCommonHeader("OpenAI-Beta", "assistants=v2").
-			SetCommonBearerAuthToken(token).
-			SetTimeout(20 * time.Second). // OpenAI API can be slow
-			SetCookieJar(nil).
-			SetCommonErrorResult(&helper.ErrorMessage{}),
+		Client:       client,
+		Poller:       DefaultPoller,
+		Tools:        NewTools(),
+		StreamClient: client.Clone().SetTimeout(0),
 	}
 }
 
+// beta creates a request of the Assistants API, which needs the beta header.
+// The other endpoints go without, OpenAI-compatible servers may reject it.
+// https://platform.openai.com/docs/assistants/migration
+func (c *Client) beta(client *req.Client) *req.Request {
+	return client.R().SetHeader("OpenAI-Beta", "assistants=v2")
+}
+
 // Create thread
 // https://platform.openai.com/docs/api-reference/threads/createThread
-func (c *Client) CreateThread() (res *Thread, err error) {
-	_, err = c.Client.R().
+func (c *Client) CreateThread(ctx context.Context) (res *Thread, err error) {
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetHeader("Content-Type", "application/json").
 		SetSuccessResult(&res).
@@ -99,11 +265,34 @@ func (c *Client) CreateThread() (res *Thread, err error) {
 
 // Create message
 // https://platform.openai.com/docs/api-reference/messages/createMessage
-func (c *Client) CreateMessage(threadId, content string) (res *Message, err error) {
-	_, err = c.Client.R().
+// images turn content into multiple parts
+func (c *Client) CreateMessage(ctx context.Context, threadId, content string, attachments ...Attachment) (res *Message, err error) {
+	body := I{"role": "user", "content": content}
+
+	var parts []I
+	var files []Attachment
+
+	for _, attachment := range attachments {
+		if attachment.image {
+			parts = append(parts, attachment.part())
+		} else {
+			files = append(files, attachment)
+		}
+	}
+
+	if len(parts) > 0 {
+		body["content"] = append([]I{{"type": "text", "text": content}}, parts...)
+	}
+
+	if len(files) > 0 {
+		body["attachments"] = files
+	}
+
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetHeader("Content-Type", "application/json").
-		SetBody(S{"role": "user", "content": content}).
+		SetBody(body).
 		SetSuccessResult(&res).
 		SetPathParam("threadId", threadId).
 		Post("/v1/threads/{threadId}/messages")
@@ -112,8 +301,9 @@ func (c *Client) CreateMessage(threadId, content string) (res *Message, err erro
 
 // List messages
 // https://platform.openai.com/docs/api-reference/messages/listMessages
-func (c *Client) ListMessages(threadId, messageIId string) (res *Messages, err error) {
-	_, err = c.Client.R().
+func (c *Client) ListMessages(ctx context.Context, threadId, messageIId string) (res *Messages, err error) {
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetSuccessResult(&res).
 		SetQueryParams(S{"before": messageIId}).
@@ -124,11 +314,12 @@ func (c *Client) ListMessages(threadId, messageIId string) (res *Messages, err e
 
 // Create run
 // https://platform.openai.com/docs/api-reference/runs/createRun
-func (c *Client) CreateRun(threadId string) (res *Run, err error) {
-	_, err = c.Client.R().
+func (c *Client) CreateRun(ctx context.Context, threadId string) (res *Run, err error) {
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetHeader("Content-Type", "application/json").
-		SetBody(S{"assistant_id": os.Getenv("OPENAI_ASSISTANTS_ID")}).
+		SetBody(S{"assistant_id": c.AssistantId}).
 		SetSuccessResult(&res).
 		SetPathParam("threadId", threadId).
 		Post("/v1/threads/{threadId}/runs")
@@ -137,66 +328,59 @@ func (c *Client) CreateRun(threadId string) (res *Run, err error) {
 
 // Retrieve run
 // https://platform.openai.com/docs/api-reference/runs/getRun
-// status: queued, in_progress, requires_action, cancelling, cancelled, failed, completed, expired
-func (c *Client) WaitForRunCompleted(threadId, runId string) (res *Run, err error) {
-	_, err = c.Client.R().
+func (c *Client) GetRun(ctx context.Context, threadId, runId string) (res *Run, err error) {
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetSuccessResult(&res).
 		SetPathParam("threadId", threadId).
 		SetPathParam("runId", runId).
-		SetRetryCount(20).
-		// SetRetryFixedInterval(500 * time.Millisecond).
-		SetRetryFixedInterval(2 * time.Second).
-		SetRetryCondition(func(res *req.Response, err error) bool {
-			if err != nil {
-				return false
-			}
-
-			run, ok := res.SuccessResult().(*Run)
-			if !ok {
-				return false
-			}
-
-			switch run.Status {
-			case "queued", "in_progress":
-				return true
-			default:
-				return false
-			}
-		}).
 		Get("/v1/threads/{threadId}/runs/{runId}")
+	return
+}
 
-	if res.Status != "completed" {
-		return nil, fmt.Errorf("failed to wait for run completed: %v", res)
-	}
-
+// Cancel run
+// https://platform.openai.com/docs/api-reference/runs/cancelRun
+func (c *Client) CancelRun(ctx context.Context, threadId, runId string) (res *Run, err error) {
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
+		SetHeader("Accept", "application/json").
+		SetSuccessResult(&res).
+		SetPathParam("threadId", threadId).
+		SetPathParam("runId", runId).
+		Post("/v1/threads/{threadId}/runs/{runId}/cancel")
 	return
 }
 
+// Poll the run until it is completed, see Poller
+func (c *Client) WaitForRunCompleted(ctx context.Context, threadId, runId string) (*Run, error) {
+	return c.Poller.Poll(ctx, c, threadId, runId)
+}
+
 // process OpenAI's Q'n'A flow, which is totally over-engineered
-func (c *Client) SendMessageAndWaitForAnswer(threadId, content string) (string, error) {
-	message, err := c.CreateMessage(threadId, content)
+func (c *Client) SendMessageAndWaitForAnswer(ctx context.Context, threadId, content string, attachments ...Attachment) (*Answer, error) {
+	message, err := c.CreateMessage(ctx, threadId, content, attachments...)
 	if err != nil {
-		return "", fmt.Errorf("failed to create message: %w", err)
+		return nil, fmt.Errorf("failed to create message: %w", err)
 	}
 
-	run, err := c.CreateRun(threadId)
+	run, err := c.CreateRun(ctx, threadId)
 	if err != nil {
-		return "", fmt.Errorf("failed to create run: %w", err)
+		return nil, fmt.Errorf("failed to create run: %w", err)
 	}
 
-	_, err = c.WaitForRunCompleted(threadId, run.Id)
+	run, err = c.WaitForRunCompleted(ctx, threadId, run.Id)
 	if err != nil {
-		return "", fmt.Errorf("failed to get run: %w", err)
+		return nil, fmt.Errorf("failed to wait for run completed: %w", err)
 	}
 
-	messages, err := c.ListMessages(threadId, message.Id)
+	messages, err := c.ListMessages(ctx, threadId, message.Id)
 	if err != nil {
-		return "", fmt.Errorf("failed to list messages: %w", err)
+		return nil, fmt.Errorf("failed to list messages: %w", err)
 	}
 
 	if len(messages.Data) == 0 {
-		return "", fmt.Errorf("failed to get response from OpenAI: no messages")
+		return nil, fmt.Errorf("failed to get response from OpenAI: no messages")
 	}
 
 	answers := make([]string, 0)
@@ -208,34 +392,50 @@ func (c *Client) SendMessageAndWaitForAnswer(threadId, content string) (string,
 	// reverse
 	sort.Slice(answers, func(i, j int) bool { return true })
 
-	return strings.Join(answers, "\n\n"), nil
+	return newAnswer(strings.Join(answers, "\n\n"), run), nil
 }
 
 // Upload file
 // https://platform.openai.com/docs/api-reference/files/create
-func (c *Client) UploadFile(paramName, filePath string) (res *File, err error) {
-	_, err = c.Client.R().
+// file is streamed, purpose is e.g. "assistants"
+func (c *Client) UploadFile(ctx context.Context, purpose, fileName string, file io.Reader) (res *File, err error) {
+	_, err = c.StreamClient.R().
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
-		SetFile(paramName, filePath).
+		SetFileReader("file", fileName, file).
 		SetSuccessResult(&res).
-		SetFormData(S{"purpose": "assistants"}).
+		SetFormData(S{"purpose": purpose}).
 		Post("/v1/files")
 	return
 }
 
 // Create assistant
 // https://platform.openai.com/docs/api-reference/assistants/createAssistant
-func (c *Client) CreateAssistant(name, instructions, model, toolType string, fileIds []string) (res *Assistant, err error) {
-	_, err = c.Client.R().
+// the files are searched with file_search in a new vector store, all
+// registered Tools are added as functions
+func (c *Client) CreateAssistant(ctx context.Context, name, instructions, model string, fileIds []string) (res *Assistant, err error) {
+	tools := []interface{}{S{"type": "file_search"}}
+	for _, definition := range c.Tools.Definitions() {
+		tools = append(tools, definition)
+	}
+
+	body := I{
+		"name":         name,
+		"instructions": instructions,
+		"model":        model,
+		"tools":        tools,
+	}
+
+	// https://platform.openai.com/docs/assistants/tools/file-search
+	if len(fileIds) > 0 {
+		body["tool_resources"] = I{"file_search": I{"vector_stores": []I{{"file_ids": fileIds}}}}
+	}
+
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetHeader("Content-Type", "application/json").
-		SetBody(I{
-			"name":         name,
-			"instructions": instructions,
-			"model":        model,
-			"tools":        []interface{}{S{"type": toolType}},
-			"file_ids":     fileIds,
-		}).
+		SetBody(body).
 		SetSuccessResult(&res).
 		Post("/v1/assistants")
 	return
@@ -0,0 +1,152 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRunFailed    = errors.New("run failed")
+	ErrRunExpired   = errors.New("run expired")
+	ErrRunCancelled = errors.New("run cancelled")
+	ErrRunTimeout   = errors.New("run timed out")
+)
+
+// RunError is returned when a run doesn't complete. Use errors.Is with one of
+// the ErrRun* errors to find out why.
+type RunError struct {
+	// last known state of the run, nil if it was never retrieved
+	Run *Run
+	Err error
+}
+
+func (e *RunError) Error() string {
+	if e.Run != nil && e.Run.LastError != nil {
+		return fmt.Sprintf("%v: %s: %s", e.Err, e.Run.LastError.Code, e.Run.LastError.Message)
+	}
+
+	return e.Err.Error()
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// Poller retrieves a run with exponential backoff until it reaches a final
+// status.
+type Poller struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// an earlier deadline of the context passed in wins, 0 waits until that
+	Timeout time.Duration
+	// time granted to cancel the remote run after the deadline expired
+	CancelTimeout time.Duration
+}
+
+var DefaultPoller = Poller{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	Multiplier:      1.5,
+	Timeout:         2 * time.Minute,
+	CancelTimeout:   10 * time.Second,
+}
+
+// withTimeout applies Timeout, the earlier of it and the deadline of ctx wins.
+func (p *Poller) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+func (p *Poller) next(interval time.Duration) time.Duration {
+	return min(time.Duration(float64(interval)*p.Multiplier), p.MaxInterval)
+}
+
+// Poll waits until the run is completed. If ctx is done before, the remote
+// run is cancelled, so it doesn't keep the thread locked.
+// status: queued, in_progress, requires_action, cancelling, cancelled, failed, completed, expired
+func (p *Poller) Poll(ctx context.Context, c *Client, threadId, runId string) (*Run, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var run *Run
+	interval := p.InitialInterval
+
+	for {
+		res, err := c.GetRun(ctx, threadId, runId)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, p.abort(ctx, c, threadId, runId, run)
+			}
+
+			return nil, fmt.Errorf("failed to get run: %w", err)
+		}
+
+		run = res
+
+		if run.Status == "requires_action" {
+			run, err = c.SubmitToolOutputs(ctx, threadId, runId, c.Tools.Call(ctx, run.RequiredAction))
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, p.abort(ctx, c, threadId, runId, res)
+				}
+
+				return nil, fmt.Errorf("failed to submit tool outputs: %w", err)
+			}
+
+			// the run continues with the outputs, look again soon
+			interval = p.InitialInterval
+		}
+
+		if err := runStatusError(run); err != nil || run.Status == "completed" {
+			return run, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, p.abort(ctx, c, threadId, runId, run)
+		case <-time.After(interval):
+		}
+
+		interval = p.next(interval)
+	}
+}
+
+// abort cancels the remote run after ctx is done and returns the matching
+// error.
+func (p *Poller) abort(ctx context.Context, c *Client, threadId, runId string, run *Run) error {
+	cancelCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.CancelTimeout)
+	defer cancel()
+
+	_, cancelErr := c.CancelRun(cancelCtx, threadId, runId)
+
+	var err error = &RunError{Run: run, Err: ErrRunTimeout}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = ctx.Err()
+	}
+
+	if cancelErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to cancel run: %w", cancelErr))
+	}
+
+	return err
+}
+
+// runStatusError returns a RunError for final states other than completed.
+func runStatusError(run *Run) error {
+	switch run.Status {
+	case "queued", "in_progress", "requires_action", "completed":
+		return nil
+	case "expired":
+		return &RunError{Run: run, Err: ErrRunExpired}
+	case "cancelling", "cancelled":
+		return &RunError{Run: run, Err: ErrRunCancelled}
+	default:
+		return &RunError{Run: run, Err: ErrRunFailed}
+	}
+}
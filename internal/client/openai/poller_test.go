@@ -0,0 +1,255 @@
+package openai_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/testserver"
+)
+
+type env struct {
+	server   *testserver.OpenAI
+	client   *openai.Client
+	threadId string
+}
+
+// setup creates a thread on the test server, runs go through statuses
+func setup(t *testing.T, statuses ...string) *env {
+	t.Helper()
+
+	e := &env{server: testserver.NewOpenAI()}
+	t.Cleanup(e.server.Close)
+
+	e.server.RunStatuses = statuses
+
+	e.client = openai.New(e.server.URL, "sk-test", "")
+	e.client.Poller = openai.Poller{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		Multiplier:      2,
+		Timeout:         5 * time.Second,
+		CancelTimeout:   time.Second,
+	}
+
+	thread, err := e.client.CreateThread(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.threadId = thread.Id
+
+	return e
+}
+
+func (e *env) run(t *testing.T) string {
+	t.Helper()
+
+	run, err := e.client.CreateRun(context.Background(), e.threadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return run.Id
+}
+
+// requests returns the requests of the run's endpoint, e.g. "GET" for
+// retrievals and "POST /cancel"
+func (e *env) requests(runId string) []string {
+	var requests []string
+
+	for _, r := range e.server.Requests() {
+		_, rest, ok := strings.Cut(r.Path, "/runs/"+runId)
+		if ok {
+			requests = append(requests, strings.TrimSpace(r.Method+" "+rest))
+		}
+	}
+
+	return requests
+}
+
+func TestPollCompletes(t *testing.T) {
+	e := setup(t, "queued", "in_progress", "in_progress", "completed")
+	e.server.Usage = openai.Usage{TotalTokens: 42}
+
+	runId := e.run(t)
+
+	run, err := e.client.WaitForRunCompleted(context.Background(), e.threadId, runId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if run.Status != "completed" || run.Usage == nil || run.Usage.TotalTokens != 42 {
+		t.Fatalf("unexpected run %+v", run)
+	}
+
+	// created queued, then retrieved until completed
+	if requests := e.requests(runId); len(requests) != 3 {
+		t.Fatalf("expected 3 retrievals, got %v", requests)
+	}
+}
+
+func TestPollReturnsRunErrors(t *testing.T) {
+	for status, want := range map[string]error{
+		"failed":     openai.ErrRunFailed,
+		"expired":    openai.ErrRunExpired,
+		"cancelling": openai.ErrRunCancelled,
+		"cancelled":  openai.ErrRunCancelled,
+		"incomplete": openai.ErrRunFailed,
+	} {
+		t.Run(status, func(t *testing.T) {
+			e := setup(t, "queued", "in_progress", status)
+			e.server.LastError = &openai.RunLastError{Code: "rate_limit_exceeded", Message: "You exceeded your current quota."}
+
+			_, err := e.client.WaitForRunCompleted(context.Background(), e.threadId, e.run(t))
+			if !errors.Is(err, want) {
+				t.Fatalf("expected %v, got %v", want, err)
+			}
+
+			var runErr *openai.RunError
+			if !errors.As(err, &runErr) || runErr.Run == nil || runErr.Run.Status != status {
+				t.Fatalf("expected the run in the error, got %#v", err)
+			}
+
+			// the API only explains failed and expired runs
+			if hasReason := strings.Contains(err.Error(), "rate_limit_exceeded: You exceeded your current quota."); hasReason != (status == "failed" || status == "expired") {
+				t.Fatalf("unexpected message %q", err)
+			}
+		})
+	}
+}
+
+func TestPollTimeoutCancelsRemoteRun(t *testing.T) {
+	e := setup(t, "queued", "in_progress")
+	e.client.Poller.Timeout = 20 * time.Millisecond
+
+	runId := e.run(t)
+
+	_, err := e.client.WaitForRunCompleted(context.Background(), e.threadId, runId)
+	if !errors.Is(err, openai.ErrRunTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	var runErr *openai.RunError
+	if !errors.As(err, &runErr) || runErr.Run == nil || runErr.Run.Status != "in_progress" {
+		t.Fatalf("expected the last known run in the error, got %#v", err)
+	}
+
+	requests := e.requests(runId)
+	if requests[len(requests)-1] != "POST /cancel" {
+		t.Fatalf("expected the run to be cancelled, got %v", requests)
+	}
+
+	run, err := e.client.GetRun(context.Background(), e.threadId, runId)
+	if err != nil || run.Status != "cancelled" {
+		t.Fatalf("expected the remote run to be cancelled, got %+v %v", run, err)
+	}
+}
+
+func TestPollLaterDeadlineOfContextDoesNotOverrideTimeout(t *testing.T) {
+	e := setup(t, "queued", "in_progress")
+	e.client.Poller.Timeout = 20 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := e.client.WaitForRunCompleted(ctx, e.threadId, e.run(t))
+	if !errors.Is(err, openai.ErrRunTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected Timeout to apply, waited %v", elapsed)
+	}
+}
+
+func TestPollEarlierDeadlineOfContextWins(t *testing.T) {
+	e := setup(t, "queued", "in_progress")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// Timeout of 5s doesn't apply as ctx ends earlier
+	_, err := e.client.WaitForRunCompleted(ctx, e.threadId, e.run(t))
+	if !errors.Is(err, openai.ErrRunTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestPollCancelledContextCancelsRemoteRun(t *testing.T) {
+	e := setup(t, "queued", "in_progress")
+
+	runId := e.run(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for len(e.requests(runId)) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	_, err := e.client.WaitForRunCompleted(ctx, e.threadId, runId)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, openai.ErrRunTimeout) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	requests := e.requests(runId)
+	if requests[len(requests)-1] != "POST /cancel" {
+		t.Fatalf("expected the run to be cancelled, got %v", requests)
+	}
+}
+
+func TestPollBackoffIsCapped(t *testing.T) {
+	e := setup(t, "queued", "in_progress", "in_progress", "in_progress", "in_progress", "completed")
+	// uncapped the waits were 1ms, 100ms, 10s, ... and the timeout hit
+	e.client.Poller.Multiplier = 100
+	e.client.Poller.MaxInterval = 10 * time.Millisecond
+	e.client.Poller.Timeout = 2 * time.Second
+
+	runId := e.run(t)
+
+	if _, err := e.client.WaitForRunCompleted(context.Background(), e.threadId, runId); err != nil {
+		t.Fatal(err)
+	}
+
+	var times []time.Time
+	for _, r := range e.server.Requests() {
+		if r.Method == "GET" && strings.HasSuffix(r.Path, "/runs/"+runId) {
+			times = append(times, r.Time)
+		}
+	}
+
+	if len(times) != 5 {
+		t.Fatalf("expected 5 retrievals, got %d", len(times))
+	}
+
+	// the first wait is InitialInterval, all later ones MaxInterval
+	for i := 2; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 10*time.Millisecond {
+			t.Fatalf("expected to wait MaxInterval before retrieval %d, waited %v", i, gap)
+		}
+	}
+}
+
+func TestPollSubmitsToolOutputs(t *testing.T) {
+	e := setup(t, "queued", "requires_action", "in_progress", "completed")
+	e.server.ToolCalls = []openai.ToolCall{{Id: "call_1", Type: "function"}}
+	e.server.ToolCalls[0].Function.Name = "unknown"
+
+	runId := e.run(t)
+
+	run, err := e.client.WaitForRunCompleted(context.Background(), e.threadId, runId)
+	if err != nil || run.Status != "completed" {
+		t.Fatalf("expected completion, got %+v %v", run, err)
+	}
+
+	if outputs := e.server.ToolOutputs(); len(outputs) != 1 || outputs[0].ToolCallId != "call_1" {
+		t.Fatalf("expected an output for the tool call, got %v", outputs)
+	}
+}
@@ -0,0 +1,191 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/imroc/req/v3"
+)
+
+// https://platform.openai.com/docs/api-reference/assistants-streaming/message-delta-object
+type MessageDelta struct {
+	Id    string `json:"id"`
+	Delta struct {
+		Content []struct {
+			Index int  `json:"index"`
+			Text  Text `json:"text"`
+		} `json:"content"`
+	} `json:"delta"`
+}
+
+// readEvents parses a server-sent events stream and calls fn for every event.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func readEvents(r io.Reader, fn func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var event string
+	var data bytes.Buffer
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				if err := fn(event, bytes.TrimSuffix(data.Bytes(), []byte("\n"))); err != nil {
+					return err
+				}
+			}
+			event = ""
+			data.Reset()
+
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			data.WriteByte('\n')
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Create run with streaming
+// https://platform.openai.com/docs/api-reference/runs/createRun
+// https://platform.openai.com/docs/api-reference/assistants-streaming/events
+// onDelta is called with every chunk of the answer, the returned run is the
+// one of the final thread.run.* event. Required tool calls are executed and
+// their outputs streamed, the deadline is handled like in Poller.
+func (c *Client) CreateRunStream(ctx context.Context, threadId string, onDelta func(text string)) (*Run, error) {
+	ctx, cancel := c.Poller.withTimeout(ctx)
+	defer cancel()
+
+	run, err := c.stream(c.beta(c.StreamClient).
+		SetContext(ctx).
+		SetBody(I{"assistant_id": c.AssistantId, "stream": true}).
+		SetPathParam("threadId", threadId),
+		"/v1/threads/{threadId}/runs",
+		onDelta,
+	)
+
+	// https://platform.openai.com/docs/api-reference/runs/submitToolOutputs
+	for err == nil && run.Status == "requires_action" {
+		var next *Run
+
+		next, err = c.stream(c.beta(c.StreamClient).
+			SetContext(ctx).
+			SetBody(I{"tool_outputs": c.Tools.Call(ctx, run.RequiredAction), "stream": true}).
+			SetPathParam("threadId", threadId).
+			SetPathParam("runId", run.Id),
+			"/v1/threads/{threadId}/runs/{runId}/submit_tool_outputs",
+			onDelta,
+		)
+		if next != nil {
+			run = next
+		}
+	}
+
+	if ctx.Err() != nil && run != nil {
+		return nil, c.Poller.abort(ctx, c, threadId, run.Id, run)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runStatusError(run); err != nil {
+		return run, err
+	}
+
+	if run.Status != "completed" {
+		return run, fmt.Errorf("stream ended before run completed: %s", run.Status)
+	}
+
+	return run, nil
+}
+
+// stream posts the request and reads the events until the stream ends or
+// the run requires action. Returns the last run seen, even with an error.
+func (c *Client) stream(r *req.Request, url string, onDelta func(text string)) (run *Run, err error) {
+	res, err := r.
+		SetHeader("Accept", "text/event-stream").
+		SetHeader("Content-Type", "application/json").
+		DisableAutoReadResponse().
+		Post(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsErrorState() {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("failed to stream run: %s: %s", res.Status, body)
+	}
+
+	err = readEvents(res.Body, func(event string, data []byte) error {
+		switch {
+		case event == "thread.message.delta":
+			var delta MessageDelta
+			if err := json.Unmarshal(data, &delta); err != nil {
+				return fmt.Errorf("failed to decode message delta: %w", err)
+			}
+
+			for _, content := range delta.Delta.Content {
+				onDelta(content.Text.Value)
+			}
+
+		case strings.HasPrefix(event, "thread.run.") && !strings.HasPrefix(event, "thread.run.step."):
+			var next Run
+			if err := json.Unmarshal(data, &next); err != nil {
+				return fmt.Errorf("failed to decode run: %w", err)
+			}
+
+			run = &next
+
+		case event == "error":
+			return fmt.Errorf("stream error: %s", data)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return run, err
+	}
+
+	if run == nil {
+		return nil, fmt.Errorf("stream ended without run")
+	}
+
+	return run, nil
+}
+
+// same as SendMessageAndWaitForAnswer, but the answer is passed to onDelta
+// while it is generated
+func (c *Client) SendMessageAndStreamAnswer(ctx context.Context, threadId, content string, onDelta func(text string), attachments ...Attachment) (*Answer, error) {
+	if _, err := c.CreateMessage(ctx, threadId, content, attachments...); err != nil {
+		return nil, fmt.Errorf("failed to create message: %w", err)
+	}
+
+	var answer strings.Builder
+
+	run, err := c.CreateRunStream(ctx, threadId, func(text string) {
+		answer.WriteString(text)
+		onDelta(text)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream run: %w", err)
+	}
+
+	if answer.Len() == 0 {
+		return nil, fmt.Errorf("failed to get response from OpenAI: no messages")
+	}
+
+	return newAnswer(answer.String(), run), nil
+}
@@ -0,0 +1,153 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// https://platform.openai.com/docs/api-reference/runs/object#runs/object-required_action
+type RequiredAction struct {
+	Type              string `json:"type"`
+	SubmitToolOutputs struct {
+		ToolCalls []ToolCall `json:"tool_calls"`
+	} `json:"submit_tool_outputs"`
+}
+
+type ToolCall struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type ToolOutput struct {
+	ToolCallId string `json:"tool_call_id"`
+	Output     string `json:"output"`
+}
+
+// ToolFunc executes a function call. arguments is the JSON object generated by
+// the model according to the registered parameters schema, the returned
+// string is passed back to the model as is.
+type ToolFunc func(ctx context.Context, arguments json.RawMessage) (string, error)
+
+type Tool struct {
+	Name        string
+	Description string
+	// JSON schema of the arguments object
+	// https://platform.openai.com/docs/guides/function-calling
+	Parameters I
+	Func       ToolFunc
+}
+
+// Tools is the registry of Go functions the assistant is allowed to call.
+type Tools struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+func NewTools() *Tools {
+	return &Tools{tools: map[string]Tool{}}
+}
+
+// Register adds a tool, an existing tool with the same name is replaced.
+func (t *Tools) Register(tool Tool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tools[tool.Name] = tool
+}
+
+// Definitions returns the tools in the format expected by the "tools"
+// parameter of assistants and runs.
+func (t *Tools) Definitions() []I {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	definitions := make([]I, 0, len(t.tools))
+
+	for _, tool := range t.tools {
+		definitions = append(definitions, I{
+			"type": "function",
+			"function": I{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"parameters":  tool.Parameters,
+			},
+		})
+	}
+
+	// stable order, so assistants don't change on every setup
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i]["function"].(I)["name"].(string) < definitions[j]["function"].(I)["name"].(string)
+	})
+
+	return definitions
+}
+
+// Call executes all tool calls the run requires.
+func (t *Tools) Call(ctx context.Context, action *RequiredAction) []ToolOutput {
+	if action == nil {
+		return nil
+	}
+
+	return t.Execute(ctx, action.SubmitToolOutputs.ToolCalls)
+}
+
+// Execute runs the calls concurrently. Failing calls are reported to the model
+// instead of aborting, so it can react on it.
+func (t *Tools) Execute(ctx context.Context, calls []ToolCall) []ToolOutput {
+	outputs := make([]ToolOutput, len(calls))
+
+	var wg sync.WaitGroup
+
+	for i, call := range calls {
+		wg.Add(1)
+
+		go func(i int, call ToolCall) {
+			defer wg.Done()
+
+			output, err := t.call(ctx, call)
+			if err != nil {
+				output = fmt.Sprintf("error: %v", err)
+			}
+
+			outputs[i] = ToolOutput{ToolCallId: call.Id, Output: output}
+		}(i, call)
+	}
+
+	wg.Wait()
+
+	return outputs
+}
+
+func (t *Tools) call(ctx context.Context, call ToolCall) (string, error) {
+	t.mu.RLock()
+	tool, ok := t.tools[call.Function.Name]
+	t.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("unknown function %q", call.Function.Name)
+	}
+
+	return tool.Func(ctx, json.RawMessage(call.Function.Arguments))
+}
+
+// Submit tool outputs to run
+// https://platform.openai.com/docs/api-reference/runs/submitToolOutputs
+func (c *Client) SubmitToolOutputs(ctx context.Context, threadId, runId string, outputs []ToolOutput) (res *Run, err error) {
+	_, err = c.beta(c.Client).
+		SetContext(ctx).
+		SetHeader("Accept", "application/json").
+		SetHeader("Content-Type", "application/json").
+		SetBody(I{"tool_outputs": outputs}).
+		SetSuccessResult(&res).
+		SetPathParam("threadId", threadId).
+		SetPathParam("runId", runId).
+		Post("/v1/threads/{threadId}/runs/{runId}/submit_tool_outputs")
+	return
+}
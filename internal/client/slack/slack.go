@@ -1,10 +1,14 @@
 package slack
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dominikwinter/slackgpt/internal/blockkit"
 	"github.com/dominikwinter/slackgpt/internal/client/helper"
 	"github.com/imroc/req/v3"
 )
@@ -12,12 +16,27 @@ import (
 type I = map[string]interface{}
 type S = map[string]string
 
+// https://api.slack.com/methods/conversations.replies#examples
 type History struct {
-	Messages []Message `json:"messages"`
+	Ok               bool      `json:"ok"`
+	Error            string    `json:"error"`
+	Messages         []Message `json:"messages"`
+	HasMore          bool      `json:"has_more"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
 }
 
+// https://api.slack.com/events/message
 type Message struct {
-	Blocks []Block `json:"blocks"`
+	Type     string  `json:"type"`
+	Subtype  string  `json:"subtype"`
+	User     string  `json:"user"`
+	BotId    string  `json:"bot_id"`
+	Text     string  `json:"text"`
+	Ts       string  `json:"ts"`
+	ThreadTs string  `json:"thread_ts"`
+	Blocks   []Block `json:"blocks"`
 }
 
 type Block struct {
@@ -28,77 +47,265 @@ type Element struct {
 	Text string `json:"text"`
 }
 
+// https://api.slack.com/types/file
+type File struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	Mimetype   string `json:"mimetype"`
+	Filetype   string `json:"filetype"`
+	Size       int    `json:"size"`
+	UrlPrivate string `json:"url_private"`
+	Permalink  string `json:"permalink"`
+}
+
+// https://api.slack.com/types/user
+type User struct {
+	Id       string      `json:"id"`
+	Name     string      `json:"name"`
+	RealName string      `json:"real_name"`
+	Tz       string      `json:"tz"`
+	TzLabel  string      `json:"tz_label"`
+	TzOffset int         `json:"tz_offset"`
+	IsBot    bool        `json:"is_bot"`
+	Profile  UserProfile `json:"profile"`
+}
+
+// https://api.slack.com/methods/users.profile.get#profile
+type UserProfile struct {
+	RealName    string `json:"real_name"`
+	DisplayName string `json:"display_name"`
+	Title       string `json:"title"`
+	Pronouns    string `json:"pronouns"`
+	StatusText  string `json:"status_text"`
+}
+
+type UserInfo struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+	User  *User  `json:"user"`
+}
+
+type UserProfileInfo struct {
+	Ok      bool         `json:"ok"`
+	Error   string       `json:"error"`
+	Profile *UserProfile `json:"profile"`
+}
+
+// https://api.slack.com/types/conversation
+type Conversation struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	IsChannel  bool   `json:"is_channel"`
+	IsGroup    bool   `json:"is_group"`
+	IsIm       bool   `json:"is_im"`
+	IsMpim     bool   `json:"is_mpim"`
+	IsPrivate  bool   `json:"is_private"`
+	NumMembers int    `json:"num_members"`
+	Topic      struct {
+		Value string `json:"value"`
+	} `json:"topic"`
+	Purpose struct {
+		Value string `json:"value"`
+	} `json:"purpose"`
+}
+
+type ConversationInfo struct {
+	Ok      bool          `json:"ok"`
+	Error   string        `json:"error"`
+	Channel *Conversation `json:"channel"`
+}
+
+type Connection struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+	Url   string `json:"url"`
+}
+
+// https://api.slack.com/methods/oauth.v2.access#examples
+type OAuthAccess struct {
+	Ok          bool   `json:"ok"`
+	Error       string `json:"error"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	BotUserId   string `json:"bot_user_id"`
+	AppId       string `json:"app_id"`
+	Team        struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"team"`
+}
+
 type Client struct {
 	Client *req.Client
+	// same as Client, but without timeout as downloads take as long as the
+	// file needs, they are bounded by their context
+	FileClient *req.Client
 }
 
+type tokenKey struct{}
+
+// ContextWithToken makes every request with the returned context use token
+// instead of the one the client was created with, e.g. the bot token of the
+// workspace an event came from.
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// New creates a client, token may be empty if every request carries one via
+// ContextWithToken.
 func New(url, token string) *Client {
 	if url == "" {
 		panic("url not set")
 	}
 
-	if token == "" {
-		panic("token not set")
+	client := req.C().
+		// EnableDumpAll().
+		SetBaseURL(url).
+		SetUserAgent("github.com/dominikwinter/slackgpt").
+		SetCommonHeader("Accept", "application/json").
+		SetCommonHeader("Content-Type", "application/json; charset=utf-8").
+		SetTimeout(5 * time.Second).
+		SetCookieJar(nil).
+		SetCommonErrorResult(&helper.ErrorMessage{}).
+		// runs before the common headers are applied, so it wins
+		OnBeforeRequest(func(c *req.Client, r *req.Request) error {
+			if token, ok := r.Context().Value(tokenKey{}).(string); ok && token != "" {
+				r.SetBearerAuthToken(token)
+			}
+			return nil
+		})
+
+	if token != "" {
+		client.SetCommonBearerAuthToken(token)
 	}
 
 	return &Client{
-		Client: req.C().
-			// EnableDumpAll().
-			SetBaseURL(url).
-			SetUserAgent("github.com/dominikwinter/slackgpt").
-			SetCommonHeader("Accept", "application/json").
-			SetCommonHeader("Content-Type", "application/json; charset=utf-8").
-			SetCommonBearerAuthToken(token).
-			SetTimeout(5 * time.Second).
-			SetCookieJar(nil).
-			SetCommonErrorResult(&helper.ErrorMessage{}),
+		Client:     client,
+		FileClient: client.Clone().SetTimeout(0),
 	}
 }
 
 // https://api.slack.com/methods/chat.postMessage
-func (c *Client) StartThread(text, channel, threadTs, aiThreadId string) (res *I, err error) {
-	parts := strings.Split(strings.TrimSpace(text), "\n")
-	var blocks []I
-
-	for _, part := range parts {
-		text := strings.TrimSpace(part)
-		if text == "" {
-			continue
-		}
-
-		blocks = append(blocks, I{"type": "section", "text": I{"type": "mrkdwn", "text": text}})
-	}
-
-	blocks = append(blocks, I{"type": "context", "elements": []I{{"type": "plain_text", "text": strings.Replace(aiThreadId, "thread_", "", 1)}}})
-
+func (c *Client) StartThread(ctx context.Context, text, channel, threadTs, aiThreadId string) (res *I, err error) {
 	_, err = c.Client.R().
+		SetContext(ctx).
 		SetBody(I{
 			"channel":   channel,
 			"thread_ts": threadTs,
-			"text":      text,
-			"blocks":    blocks,
+			"text":      blockkit.Text(text),
+			"blocks":    threadBlocks(text, aiThreadId),
 		}).
 		SetSuccessResult(&res).
 		Post("/api/chat.postMessage")
 	return
 }
 
-// https://api.slack.com/methods/chat.postMessage
-func (c *Client) AddToThread(text, channel, threadTs string) (res *I, err error) {
+// https://api.slack.com/methods/chat.update
+// same layout as StartThread, used to finish a streamed first answer
+func (c *Client) UpdateThread(ctx context.Context, text, channel, ts, aiThreadId string) (res *I, err error) {
 	_, err = c.Client.R().
+		SetContext(ctx).
 		SetBody(I{
+			"channel": channel,
+			"ts":      ts,
+			"text":    blockkit.Text(text),
+			"blocks":  threadBlocks(text, aiThreadId),
+		}).
+		SetSuccessResult(&res).
+		Post("/api/chat.update")
+	return
+}
+
+// the Markdown of the answer as blocks, the last block holds the aiThreadId
+func threadBlocks(text, aiThreadId string) []I {
+	blocks := blockkit.Blocks(text, blockkit.MaxBlocks-1)
+	blocks = append(blocks, I{"type": "context", "elements": []I{{"type": "plain_text", "text": strings.Replace(aiThreadId, "thread_", "", 1)}}})
+
+	return blocks
+}
+
+// messageBody adds the Markdown of text as blocks, and as mrkdwn text for
+// notifications
+func messageBody(body I, text string) I {
+	body["text"] = blockkit.Text(text)
+
+	if blocks := blockkit.Blocks(text, blockkit.MaxBlocks); len(blocks) > 0 {
+		body["blocks"] = blocks
+	}
+
+	return body
+}
+
+// https://api.slack.com/methods/chat.postMessage
+func (c *Client) AddToThread(ctx context.Context, text, channel, threadTs string) (res *I, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetBody(messageBody(I{
 			"channel":   channel,
 			"thread_ts": threadTs,
-			"text":      text,
-		}).
+		}, text)).
 		SetSuccessResult(&res).
 		Post("/api/chat.postMessage")
 	return
 }
 
+// https://api.slack.com/methods/chat.update
+func (c *Client) UpdateMessage(ctx context.Context, text, channel, ts string) (res *I, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetBody(messageBody(I{
+			"channel": channel,
+			"ts":      ts,
+		}, text)).
+		SetSuccessResult(&res).
+		Post("/api/chat.update")
+	return
+}
+
+// https://api.slack.com/methods/chat.delete
+func (c *Client) DeleteMessage(ctx context.Context, channel, ts string) (res *I, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetBody(I{
+			"channel": channel,
+			"ts":      ts,
+		}).
+		SetSuccessResult(&res).
+		Post("/api/chat.delete")
+	return
+}
+
+// https://api.slack.com/types/file#auth
+// url is the url_private of the file, the caller must close the body
+func (c *Client) DownloadFile(ctx context.Context, url string) (body io.ReadCloser, err error) {
+	res, err := c.FileClient.R().
+		SetContext(ctx).
+		DisableAutoReadResponse().
+		Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.IsErrorState() {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to download file: %s", res.Status)
+	}
+
+	// slack answers with its login page if the token lacks files:read
+	if strings.HasPrefix(res.GetContentType(), "text/html") {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to download file: got login page, is the files:read scope missing?")
+	}
+
+	return res.Body, nil
+}
+
 // https://api.slack.com/methods/conversations.replies
-func (c *Client) GetHistory(channel, threadTs string, limit int) (res *History, err error) {
+func (c *Client) GetHistory(ctx context.Context, channel, threadTs string, limit int) (res *History, err error) {
 	_, err = c.Client.R().
+		SetContext(ctx).
 		SetQueryParams(S{
 			"channel": channel,
 			"ts":      threadTs,
@@ -110,9 +317,87 @@ func (c *Client) GetHistory(channel, threadTs string, limit int) (res *History,
 	return
 }
 
+// https://api.slack.com/methods/conversations.replies
+// one page of the thread, pass the next_cursor of the previous page for the
+// next one
+func (c *Client) GetReplies(ctx context.Context, channel, threadTs, cursor string, limit int) (res *History, err error) {
+	params := S{
+		"channel": channel,
+		"ts":      threadTs,
+		"limit":   strconv.Itoa(limit),
+	}
+
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetQueryParams(params).
+		SetSuccessResult(&res).
+		Get("/api/conversations.replies")
+	return
+}
+
+// GetThread returns all messages of the thread, the parent message first.
+func (c *Client) GetThread(ctx context.Context, channel, threadTs string) ([]Message, error) {
+	var messages []Message
+	cursor := ""
+
+	for {
+		// Slack recommends no more than 200 per page
+		res, err := c.GetReplies(ctx, channel, threadTs, cursor, 200)
+		if err != nil {
+			return nil, err
+		}
+
+		if !res.Ok {
+			return nil, fmt.Errorf("failed to get replies: %s", res.Error)
+		}
+
+		messages = append(messages, res.Messages...)
+
+		cursor = res.ResponseMetadata.NextCursor
+		if !res.HasMore || cursor == "" {
+			return messages, nil
+		}
+	}
+}
+
+// https://api.slack.com/methods/users.info
+func (c *Client) GetUserInfo(ctx context.Context, user string) (res *UserInfo, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetQueryParams(S{"user": user}).
+		SetSuccessResult(&res).
+		Get("/api/users.info")
+	return
+}
+
+// https://api.slack.com/methods/users.profile.get
+func (c *Client) GetUserProfile(ctx context.Context, user string) (res *UserProfileInfo, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetQueryParams(S{"user": user}).
+		SetSuccessResult(&res).
+		Get("/api/users.profile.get")
+	return
+}
+
+// https://api.slack.com/methods/conversations.info
+func (c *Client) GetConversationInfo(ctx context.Context, channel string) (res *ConversationInfo, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetQueryParams(S{"channel": channel}).
+		SetSuccessResult(&res).
+		Get("/api/conversations.info")
+	return
+}
+
 // https://api.slack.com/methods/reactions.add
-func (c *Client) AddReactions(channel, name, timestamp string) (res *I, err error) {
+func (c *Client) AddReactions(ctx context.Context, channel, name, timestamp string) (res *I, err error) {
 	_, err = c.Client.R().
+		SetContext(ctx).
 		SetBody(I{
 			"channel":   channel,
 			"name":      name,
@@ -124,8 +409,9 @@ func (c *Client) AddReactions(channel, name, timestamp string) (res *I, err erro
 }
 
 // https://api.slack.com/methods/reactions.remove
-func (c *Client) DelReactions(channel, name, timestamp string) (res *I, err error) {
+func (c *Client) DelReactions(ctx context.Context, channel, name, timestamp string) (res *I, err error) {
 	_, err = c.Client.R().
+		SetContext(ctx).
 		SetBody(I{
 			"channel":   channel,
 			"name":      name,
@@ -135,3 +421,29 @@ func (c *Client) DelReactions(channel, name, timestamp string) (res *I, err erro
 		Post("/api/reactions.remove")
 	return
 }
+
+// https://api.slack.com/methods/oauth.v2.access
+// exchanges the code of the OAuth redirect for a bot token, authenticated with
+// the app credentials instead of a token
+func (c *Client) OAuthAccess(ctx context.Context, clientId, clientSecret, code, redirectUrl string) (res *OAuthAccess, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetBasicAuth(clientId, clientSecret).
+		SetFormData(S{
+			"code":         code,
+			"redirect_uri": redirectUrl,
+		}).
+		SetSuccessResult(&res).
+		Post("/api/oauth.v2.access")
+	return
+}
+
+// https://api.slack.com/methods/apps.connections.open
+// requires a client created with an app-level token (xapp-...)
+func (c *Client) OpenConnection(ctx context.Context) (res *Connection, err error) {
+	_, err = c.Client.R().
+		SetContext(ctx).
+		SetSuccessResult(&res).
+		Post("/api/apps.connections.open")
+	return
+}
@@ -0,0 +1,584 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is loaded from defaults, an optional YAML file and the environment
+// (including .env), later sources override earlier ones. Every field can be
+// set by the environment variable in its `env` tag.
+type Config struct {
+	Port            string        `yaml:"port" env:"PORT"`
+	Debug           bool          `yaml:"debug" env:"DEBUG"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+
+	Events        Events        `yaml:"events"`
+	Threads       Threads       `yaml:"threads"`
+	Replies       Replies       `yaml:"replies"`
+	Installations Installations `yaml:"installations"`
+	Files         Files         `yaml:"files"`
+	Limits        Limits        `yaml:"limits"`
+	Usage         Usage         `yaml:"usage"`
+	History       History       `yaml:"history"`
+	Slack         Slack         `yaml:"slack"`
+	OpenAI        OpenAI        `yaml:"openai"`
+
+	// invalid environment variables, reported by Validate
+	errs Errors
+}
+
+type Events struct {
+	// upper bound for processing a single Slack event
+	Timeout time.Duration `yaml:"timeout" env:"EVENT_TIMEOUT"`
+	// processed event ids are remembered this long to drop retries
+	DedupTtl time.Duration `yaml:"dedup_ttl" env:"EVENT_DEDUP_TTL"`
+	// empty keeps processed event ids in memory
+	StorePath string `yaml:"store_path" env:"EVENT_STORE_PATH"`
+}
+
+type Threads struct {
+	// empty keeps the Slack to OpenAI thread mapping in memory
+	StorePath string `yaml:"store_path" env:"THREAD_STORE_PATH"`
+}
+
+type Replies struct {
+	// empty keeps the bot's answer to each question in memory
+	StorePath string `yaml:"store_path" env:"REPLY_STORE_PATH"`
+}
+
+// History of conversations with the chat backend, which doesn't keep them
+// itself.
+type History struct {
+	// "store" keeps the conversations in StorePath, "slack" reads them from
+	// the Slack thread, so the model sees what the users see
+	Source string `yaml:"source" env:"HISTORY_SOURCE"`
+	// empty keeps the conversations in memory
+	StorePath string `yaml:"store_path" env:"HISTORY_STORE_PATH"`
+	// only the latest messages are sent to the model, 0 sends all
+	MaxMessages int `yaml:"max_messages" env:"HISTORY_MAX_MESSAGES"`
+	// older messages of Slack threads are dropped beyond, 0 sends all
+	MaxTokens int `yaml:"max_tokens" env:"HISTORY_MAX_TOKENS"`
+}
+
+type Installations struct {
+	// empty keeps workspaces installed via OAuth in memory
+	StorePath string `yaml:"store_path" env:"INSTALLATION_STORE_PATH"`
+}
+
+// Files shared in a conversation are forwarded to the assistant for its
+// file_search tool, images are shown to the model if it supports vision.
+type Files struct {
+	// 0 disables forwarding
+	MaxSizeMb      int      `yaml:"max_size_mb" env:"FILE_MAX_SIZE_MB"`
+	MimeTypes      []string `yaml:"mime_types" env:"FILE_MIME_TYPES"`
+	ImageMimeTypes []string `yaml:"image_mime_types" env:"FILE_IMAGE_MIME_TYPES"`
+}
+
+// Limits protect the OpenAI bill against single users and workspaces, 0
+// disables a limit. Token and cost budgets are reset at midnight UTC.
+type Limits struct {
+	// messages per Interval
+	UserMessages int           `yaml:"user_messages" env:"LIMIT_USER_MESSAGES"`
+	TeamMessages int           `yaml:"team_messages" env:"LIMIT_TEAM_MESSAGES"`
+	Interval     time.Duration `yaml:"interval" env:"LIMIT_INTERVAL"`
+	// OpenAI tokens per day
+	UserDailyTokens int `yaml:"user_daily_tokens" env:"LIMIT_USER_DAILY_TOKENS"`
+	TeamDailyTokens int `yaml:"team_daily_tokens" env:"LIMIT_TEAM_DAILY_TOKENS"`
+	// USD per day at Usage.Prices, models without price cost nothing
+	UserDailyUsd float64 `yaml:"user_daily_usd" env:"LIMIT_USER_DAILY_USD"`
+	TeamDailyUsd float64 `yaml:"team_daily_usd" env:"LIMIT_TEAM_DAILY_USD"`
+	// empty keeps the counters in memory
+	StorePath string `yaml:"store_path" env:"LIMIT_STORE_PATH"`
+}
+
+// Usage of OpenAI tokens is recorded per team, user, channel and model and
+// reported on /api/v1/usage.
+type Usage struct {
+	// empty keeps the usage in memory
+	StorePath string `yaml:"store_path" env:"USAGE_STORE_PATH"`
+	// bearer tokens for the report, empty disables it
+	ApiKeys []string `yaml:"api_keys" env:"USAGE_API_KEYS"`
+	// model=input/output in USD per million tokens, e.g. gpt-4o=5/15. Dated
+	// model versions use the price of the longest matching prefix.
+	Prices []string `yaml:"prices" env:"USAGE_PRICES"`
+}
+
+// Price in USD per million tokens
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// ParsePrices parses Usage.Prices into a map by model.
+func ParsePrices(list []string) (map[string]Price, error) {
+	prices := map[string]Price{}
+
+	for _, item := range list {
+		model, price, ok := strings.Cut(item, "=")
+		input, output, ok2 := strings.Cut(price, "/")
+		if !ok || !ok2 || model == "" {
+			return nil, fmt.Errorf("invalid price %q, use model=input/output", item)
+		}
+
+		in, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input price %q", item)
+		}
+
+		out, err := strconv.ParseFloat(output, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output price %q", item)
+		}
+
+		prices[model] = Price{Input: in, Output: out}
+	}
+
+	return prices, nil
+}
+
+type Slack struct {
+	ApiUrl        string `yaml:"api_url" env:"SLACK_API_URL"`
+	BotToken      string `yaml:"bot_token" env:"SLACK_BOT_TOKEN"`
+	SigningSecret string `yaml:"signing_secret" env:"SLACK_SIGNING_SECRET"`
+	// "http" or "socket"
+	Transport         string        `yaml:"transport" env:"SLACK_TRANSPORT"`
+	AppToken          string        `yaml:"app_token" env:"SLACK_APP_TOKEN"`
+	Streaming         bool          `yaml:"streaming" env:"SLACK_STREAMING"`
+	StreamingInterval time.Duration `yaml:"streaming_interval" env:"SLACK_STREAMING_INTERVAL"`
+	ChannelTypes      ChannelTypes  `yaml:"channel_types"`
+	// OAuth installation into several workspaces, enabled by ClientId
+	ClientId     string   `yaml:"client_id" env:"SLACK_CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"SLACK_CLIENT_SECRET"`
+	Scopes       []string `yaml:"scopes" env:"SLACK_SCOPES"`
+	RedirectUrl  string   `yaml:"redirect_url" env:"SLACK_REDIRECT_URL"`
+}
+
+// ChannelTypes sets how the bot reacts in each kind of conversation: "all"
+// answers every message, "thread" mentions and replies in threads of the bot,
+// "mention" mentions only and "off" nothing.
+// https://api.slack.com/events/message#channel_types
+type ChannelTypes struct {
+	Im      string `yaml:"im" env:"SLACK_IM_MODE"`
+	Mpim    string `yaml:"mpim" env:"SLACK_MPIM_MODE"`
+	Channel string `yaml:"channel" env:"SLACK_CHANNEL_MODE"`
+	Group   string `yaml:"group" env:"SLACK_GROUP_MODE"`
+}
+
+var modes = []string{"all", "thread", "mention", "off"}
+
+// OAuth reports whether the app can be installed into several workspaces.
+func (s *Slack) OAuth() bool {
+	return s.ClientId != ""
+}
+
+type OpenAI struct {
+	// "assistants" keeps conversations in OpenAI threads, "chat" uses the
+	// Chat Completions API with Model and Instructions, "local" does the same
+	// with an OpenAI-compatible server like Ollama without credentials
+	Backend      string `yaml:"backend" env:"OPENAI_BACKEND"`
+	Model        string `yaml:"model" env:"OPENAI_MODEL"`
+	Instructions string `yaml:"instructions" env:"OPENAI_INSTRUCTIONS"`
+	// offer the Slack lookup functions, not every local model supports them
+	Tools bool `yaml:"tools" env:"OPENAI_TOOLS"`
+
+	// "openai" or "azure", Azure ignores Organization and uses deployment
+	// names as Model
+	ApiType            string        `yaml:"api_type" env:"OPENAI_API_TYPE"`
+	ApiVersion         string        `yaml:"api_version" env:"OPENAI_API_VERSION"`
+	ApiUrl             string        `yaml:"api_url" env:"OPENAI_API_URL"`
+	ApiKey             string        `yaml:"api_key" env:"OPENAI_API_KEY"`
+	Organization       string        `yaml:"organization" env:"OPENAI_ORGANIZATION"`
+	AssistantId        string        `yaml:"assistant_id" env:"OPENAI_ASSISTANTS_ID"`
+	RunTimeout         time.Duration `yaml:"run_timeout" env:"OPENAI_RUN_TIMEOUT"`
+	RunPollInterval    time.Duration `yaml:"run_poll_interval" env:"OPENAI_RUN_POLL_INTERVAL"`
+	RunMaxPollInterval time.Duration `yaml:"run_max_poll_interval" env:"OPENAI_RUN_MAX_POLL_INTERVAL"`
+}
+
+func Default() *Config {
+	return &Config{
+		Port:            "3000",
+		ShutdownTimeout: 20 * time.Second,
+		Events: Events{
+			Timeout: 5 * time.Minute,
+			// slack retries a delivery up to three times within about an hour
+			// https://api.slack.com/apis/connections/events-api#retries
+			DedupTtl: time.Hour,
+		},
+		Files: Files{
+			MaxSizeMb: 20,
+			// https://platform.openai.com/docs/assistants/tools/file-search/supported-files
+			MimeTypes: []string{
+				"application/pdf",
+				"application/msword",
+				"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+				"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+				"application/json",
+				"text/plain",
+				"text/markdown",
+				"text/html",
+			},
+			// https://platform.openai.com/docs/guides/vision/what-type-of-files-can-i-upload
+			ImageMimeTypes: []string{
+				"image/png",
+				"image/jpeg",
+				"image/gif",
+				"image/webp",
+			},
+		},
+		Limits: Limits{
+			Interval: time.Minute,
+		},
+		Usage: Usage{
+			// https://openai.com/api/pricing/
+			Prices: []string{
+				"gpt-4o=5/15",
+				"gpt-4o-mini=0.15/0.6",
+				"gpt-4-turbo=10/30",
+				"gpt-4=30/60",
+				"gpt-3.5-turbo=0.5/1.5",
+			},
+		},
+		Slack: Slack{
+			ApiUrl:    "https://slack.com",
+			Transport: "http",
+			// chat.update is a Tier 3 method, so roughly 50 updates per minute
+			StreamingInterval: time.Second,
+			ChannelTypes: ChannelTypes{
+				Im:      "all",
+				Mpim:    "thread",
+				Channel: "thread",
+				Group:   "thread",
+			},
+			Scopes: []string{
+				"app_mentions:read",
+				"channels:history",
+				"channels:read",
+				"chat:write",
+				"files:read",
+				"groups:history",
+				"groups:read",
+				"im:history",
+				"im:read",
+				"mpim:history",
+				"mpim:read",
+				"reactions:write",
+				"users.profile:read",
+				"users:read",
+			},
+		},
+		History: History{
+			Source:      "store",
+			MaxMessages: 50,
+			MaxTokens:   16000,
+		},
+		OpenAI: OpenAI{
+			Backend: "assistants",
+			Model:   "gpt-4o",
+			Tools:   true,
+			Instructions: `You are a feedback assistant. You are used by the user to generate feedback for a colleague. Please ask a set of maximum 10 questions to be able to write a feedback to the users colleague. The feedback should be objective and neutral.
+Decide for yourself which questions are best suited to get a complete and meaningful overall impression. The output in markdown.
+Before you can ask the user specific questions you need to find out in which competence the colleague to whom the user wants to provide feedback is working. Please also find out in which relation the user and the colleague are, e.g. is it your AL (Accountable Lead), CL (Competence Lead), is it a team member? Also ask the user in which context he wants to provide the feedback, like a project, a hackathon, day to days situations or observations from a specific meeting could be examples.
+When you ask the questions to the user it should be done 1 by 1 and not all at once, so that it is a conversation between you and the user.
+Be sure to stay in your role and don't digress from the topic at hand, even if the user asks you to.`,
+			ApiType:            "openai",
+			ApiVersion:         "2024-05-01-preview",
+			ApiUrl:             "https://api.openai.com",
+			RunTimeout:         2 * time.Minute,
+			RunPollInterval:    500 * time.Millisecond,
+			RunMaxPollInterval: 5 * time.Second,
+		},
+	}
+}
+
+// Load reads the configuration, file may be empty. Invalid values in the
+// environment are reported by Validate together with everything else, as not
+// every command needs every value.
+func Load(file string) (*Config, error) {
+	cfg := Default()
+
+	// existing environment variables win over .env
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		if err := yaml.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+		}
+	}
+
+	loadEnv(reflect.ValueOf(cfg).Elem(), &cfg.errs)
+
+	return cfg, nil
+}
+
+// loadEnv sets every field with an `env` tag from the environment.
+func loadEnv(v reflect.Value, errs *Errors) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := v.Type().Field(i).Tag.Get("env")
+
+		if !field.CanSet() {
+			continue
+		}
+
+		if field.Kind() == reflect.Struct && name == "" {
+			loadEnv(field, errs)
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok || value == "" {
+			continue
+		}
+
+		if err := set(field, value); err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+}
+
+func set(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetInt(int64(n))
+
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use e.g. 30s or 5m", value)
+		}
+		field.SetInt(int64(d))
+
+	case []string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// Validate checks everything the bot needs to run.
+func (c *Config) Validate() error {
+	errs := append(Errors{}, c.errs...)
+
+	if c.Port == "" {
+		errs = append(errs, errors.New("PORT is required"))
+	}
+
+	errs.positive("SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	errs.positive("EVENT_TIMEOUT", c.Events.Timeout)
+	errs.positive("EVENT_DEDUP_TTL", c.Events.DedupTtl)
+
+	errs.notNegative("FILE_MAX_SIZE_MB", c.Files.MaxSizeMb)
+
+	errs = append(errs, c.Limits.validate()...)
+
+	if _, err := ParsePrices(c.Usage.Prices); err != nil {
+		errs = append(errs, fmt.Errorf("USAGE_PRICES: %w", err))
+	}
+
+	errs = append(errs, c.Slack.validate()...)
+	errs = append(errs, c.OpenAI.validate()...)
+
+	errs.oneOf("HISTORY_SOURCE", c.History.Source, "store", "slack")
+	errs.notNegative("HISTORY_MAX_MESSAGES", c.History.MaxMessages)
+	errs.notNegative("HISTORY_MAX_TOKENS", c.History.MaxTokens)
+
+	switch c.OpenAI.Backend {
+	case "assistants":
+		if c.OpenAI.AssistantId == "" {
+			errs = append(errs, errors.New("OPENAI_ASSISTANTS_ID is required, create an assistant with `make create-assistant`"))
+		}
+	case "chat", "local":
+		if c.OpenAI.Model == "" {
+			errs = append(errs, fmt.Errorf("OPENAI_MODEL is required with OPENAI_BACKEND=%s", c.OpenAI.Backend))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("OPENAI_BACKEND must be assistants, chat or local, got %q", c.OpenAI.Backend))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// ValidateOpenAI checks the values needed to talk to OpenAI only.
+func (c *Config) ValidateOpenAI() error {
+	errs := append(Errors{}, c.errs...)
+	errs = append(errs, c.OpenAI.validate()...)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (l *Limits) validate() (errs Errors) {
+	errs.notNegative("LIMIT_USER_MESSAGES", l.UserMessages)
+	errs.notNegative("LIMIT_TEAM_MESSAGES", l.TeamMessages)
+	errs.notNegative("LIMIT_USER_DAILY_TOKENS", l.UserDailyTokens)
+	errs.notNegative("LIMIT_TEAM_DAILY_TOKENS", l.TeamDailyTokens)
+	errs.notNegativeFloat("LIMIT_USER_DAILY_USD", l.UserDailyUsd)
+	errs.notNegativeFloat("LIMIT_TEAM_DAILY_USD", l.TeamDailyUsd)
+
+	if l.UserMessages > 0 || l.TeamMessages > 0 {
+		errs.positive("LIMIT_INTERVAL", l.Interval)
+	}
+
+	return
+}
+
+func (s *Slack) validate() (errs Errors) {
+	errs.required("SLACK_API_URL", s.ApiUrl)
+
+	// with OAuth every workspace brings its own token
+	if s.OAuth() {
+		errs.required("SLACK_CLIENT_SECRET", s.ClientSecret)
+		errs.required("SLACK_REDIRECT_URL", s.RedirectUrl)
+
+		if len(s.Scopes) == 0 {
+			errs = append(errs, errors.New("SLACK_SCOPES is required with SLACK_CLIENT_ID"))
+		}
+	} else {
+		errs.required("SLACK_BOT_TOKEN", s.BotToken)
+	}
+
+	switch s.Transport {
+	case "http":
+		if s.SigningSecret == "" {
+			errs = append(errs, errors.New("SLACK_SIGNING_SECRET is required with SLACK_TRANSPORT=http"))
+		}
+	case "socket":
+		if s.AppToken == "" {
+			errs = append(errs, errors.New("SLACK_APP_TOKEN is required with SLACK_TRANSPORT=socket"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("SLACK_TRANSPORT must be http or socket, got %q", s.Transport))
+	}
+
+	if s.Streaming {
+		errs.positive("SLACK_STREAMING_INTERVAL", s.StreamingInterval)
+	}
+
+	errs.oneOf("SLACK_IM_MODE", s.ChannelTypes.Im, modes...)
+	errs.oneOf("SLACK_MPIM_MODE", s.ChannelTypes.Mpim, modes...)
+	errs.oneOf("SLACK_CHANNEL_MODE", s.ChannelTypes.Channel, modes...)
+	errs.oneOf("SLACK_GROUP_MODE", s.ChannelTypes.Group, modes...)
+
+	return
+}
+
+func (o *OpenAI) validate() (errs Errors) {
+	errs.required("OPENAI_API_URL", o.ApiUrl)
+	errs.oneOf("OPENAI_API_TYPE", o.ApiType, "openai", "azure")
+	if o.ApiType == "azure" {
+		errs.required("OPENAI_API_VERSION", o.ApiVersion)
+	}
+
+	// local servers usually run without authentication
+	if o.Backend != "local" {
+		errs.required("OPENAI_API_KEY", o.ApiKey)
+	}
+
+	errs.positive("OPENAI_RUN_TIMEOUT", o.RunTimeout)
+	errs.positive("OPENAI_RUN_POLL_INTERVAL", o.RunPollInterval)
+	errs.positive("OPENAI_RUN_MAX_POLL_INTERVAL", o.RunMaxPollInterval)
+	return
+}
+
+// Errors collects all problems, so they can be fixed in one go.
+type Errors []error
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  - " + err.Error()
+	}
+
+	return "invalid configuration:\n" + strings.Join(lines, "\n")
+}
+
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+func (e *Errors) required(name, value string) {
+	if value == "" {
+		*e = append(*e, fmt.Errorf("%s is required", name))
+	}
+}
+
+func (e *Errors) positive(name string, value time.Duration) {
+	if value <= 0 {
+		*e = append(*e, fmt.Errorf("%s must be greater than 0", name))
+	}
+}
+
+func (e *Errors) notNegative(name string, value int) {
+	if value < 0 {
+		*e = append(*e, fmt.Errorf("%s must not be negative", name))
+	}
+}
+
+func (e *Errors) notNegativeFloat(name string, value float64) {
+	if value < 0 {
+		*e = append(*e, fmt.Errorf("%s must not be negative", name))
+	}
+}
+
+func (e *Errors) oneOf(name, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+
+	*e = append(*e, fmt.Errorf("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), value))
+}
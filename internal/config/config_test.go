@@ -0,0 +1,246 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/config"
+)
+
+// valid returns the defaults with the values every setup has to provide
+func valid() *config.Config {
+	cfg := config.Default()
+	cfg.Slack.BotToken = "xoxb-test"
+	cfg.Slack.SigningSecret = "secret"
+	cfg.OpenAI.ApiKey = "sk-test"
+	cfg.OpenAI.AssistantId = "asst_test"
+
+	return cfg
+}
+
+func TestDefaultsAreValid(t *testing.T) {
+	if err := valid().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultsRequireCredentials(t *testing.T) {
+	err := config.Default().Validate()
+	if err == nil {
+		t.Fatal("expected missing credentials to be reported")
+	}
+
+	for _, name := range []string{"SLACK_BOT_TOKEN", "SLACK_SIGNING_SECRET", "OPENAI_API_KEY", "OPENAI_ASSISTANTS_ID"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected %s to be reported, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadEnvironmentOverridesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+port: "4000"
+debug: true
+events:
+  timeout: 1m
+slack:
+  transport: socket
+  channel_types:
+    im: mention
+openai:
+  model: gpt-4o-mini
+  run_timeout: 30s
+`
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PORT", "5000")
+	t.Setenv("OPENAI_MODEL", "")
+	t.Setenv("SLACK_CHANNEL_MODE", "off")
+	t.Setenv("LIMIT_USER_MESSAGES", "10")
+	t.Setenv("LIMIT_TEAM_DAILY_USD", "2.5")
+	t.Setenv("OPENAI_TOOLS", "false")
+	t.Setenv("FILE_MIME_TYPES", " text/plain, ,application/pdf ")
+
+	cfg, err := config.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct{ got, want interface{} }{
+		"env over file":           {cfg.Port, "5000"},
+		"file over default":       {cfg.Events.Timeout, time.Minute},
+		"file bool":               {cfg.Debug, true},
+		"nested file":             {cfg.Slack.ChannelTypes.Im, "mention"},
+		"nested env":              {cfg.Slack.ChannelTypes.Channel, "off"},
+		"empty env is unset":      {cfg.OpenAI.Model, "gpt-4o-mini"},
+		"env int":                 {cfg.Limits.UserMessages, 10},
+		"env float":               {cfg.Limits.TeamDailyUsd, 2.5},
+		"env bool":                {cfg.OpenAI.Tools, false},
+		"env list":                {cfg.Files.MimeTypes, []string{"text/plain", "application/pdf"}},
+		"default":                 {cfg.OpenAI.Backend, "assistants"},
+		"file duration":           {cfg.OpenAI.RunTimeout, 30 * time.Second},
+		"file over default mode":  {cfg.Slack.Transport, "socket"},
+		"untouched default mode":  {cfg.Slack.ChannelTypes.Group, "thread"},
+		"untouched default list":  {len(cfg.Slack.Scopes), len(config.Default().Slack.Scopes)},
+		"untouched default price": {cfg.Usage.Prices[0], "gpt-4o=5/15"},
+	} {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: expected %v, got %v", name, test.want, test.got)
+		}
+	}
+}
+
+func TestLoadReportsInvalidEnvironmentOnValidate(t *testing.T) {
+	t.Setenv("EVENT_TIMEOUT", "5")
+	t.Setenv("DEBUG", "maybe")
+	t.Setenv("FILE_MAX_SIZE_MB", "ten")
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected invalid values to be reported")
+	}
+
+	for _, want := range []string{
+		`EVENT_TIMEOUT: invalid duration "5"`,
+		`DEBUG: invalid boolean "maybe"`,
+		`FILE_MAX_SIZE_MB: invalid number "ten"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestLoadFailsOnInvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("port: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.Load(file); err == nil {
+		t.Fatal("expected invalid YAML to fail")
+	}
+
+	if _, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected a missing file to fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, test := range map[string]struct {
+		configure func(cfg *config.Config)
+		// empty if valid
+		want string
+	}{
+		"shutdown timeout": {func(cfg *config.Config) { cfg.ShutdownTimeout = 0 }, "SHUTDOWN_TIMEOUT must be greater than 0"},
+		"event timeout":    {func(cfg *config.Config) { cfg.Events.Timeout = -time.Second }, "EVENT_TIMEOUT must be greater than 0"},
+		"dedup ttl":        {func(cfg *config.Config) { cfg.Events.DedupTtl = 0 }, "EVENT_DEDUP_TTL must be greater than 0"},
+		"run timeout":      {func(cfg *config.Config) { cfg.OpenAI.RunTimeout = 0 }, "OPENAI_RUN_TIMEOUT must be greater than 0"},
+		"poll interval":    {func(cfg *config.Config) { cfg.OpenAI.RunPollInterval = 0 }, "OPENAI_RUN_POLL_INTERVAL must be greater than 0"},
+		"max poll":         {func(cfg *config.Config) { cfg.OpenAI.RunMaxPollInterval = 0 }, "OPENAI_RUN_MAX_POLL_INTERVAL must be greater than 0"},
+
+		"limit interval":         {func(cfg *config.Config) { cfg.Limits.UserMessages, cfg.Limits.Interval = 5, 0 }, "LIMIT_INTERVAL must be greater than 0"},
+		"unused limit interval":  {func(cfg *config.Config) { cfg.Limits.Interval = 0 }, ""},
+		"negative limit":         {func(cfg *config.Config) { cfg.Limits.TeamDailyTokens = -1 }, "LIMIT_TEAM_DAILY_TOKENS must not be negative"},
+		"negative cost limit":    {func(cfg *config.Config) { cfg.Limits.UserDailyUsd = -0.5 }, "LIMIT_USER_DAILY_USD must not be negative"},
+		"negative file size":     {func(cfg *config.Config) { cfg.Files.MaxSizeMb = -1 }, "FILE_MAX_SIZE_MB must not be negative"},
+		"negative history":       {func(cfg *config.Config) { cfg.History.MaxMessages = -1 }, "HISTORY_MAX_MESSAGES must not be negative"},
+		"streaming interval":     {func(cfg *config.Config) { cfg.Slack.Streaming, cfg.Slack.StreamingInterval = true, 0 }, "SLACK_STREAMING_INTERVAL must be greater than 0"},
+		"unused stream interval": {func(cfg *config.Config) { cfg.Slack.StreamingInterval = 0 }, ""},
+
+		"transport":      {func(cfg *config.Config) { cfg.Slack.Transport = "grpc" }, `SLACK_TRANSPORT must be http or socket, got "grpc"`},
+		"socket":         {func(cfg *config.Config) { cfg.Slack.Transport, cfg.Slack.SigningSecret = "socket", "" }, "SLACK_APP_TOKEN is required with SLACK_TRANSPORT=socket"},
+		"socket token":   {func(cfg *config.Config) { cfg.Slack.Transport, cfg.Slack.AppToken = "socket", "xapp-test" }, ""},
+		"channel mode":   {func(cfg *config.Config) { cfg.Slack.ChannelTypes.Im = "always" }, `SLACK_IM_MODE must be one of all, thread, mention, off, got "always"`},
+		"group mode":     {func(cfg *config.Config) { cfg.Slack.ChannelTypes.Group = "" }, "SLACK_GROUP_MODE must be one of"},
+		"backend":        {func(cfg *config.Config) { cfg.OpenAI.Backend = "completions" }, `OPENAI_BACKEND must be assistants, chat or local, got "completions"`},
+		"chat model":     {func(cfg *config.Config) { cfg.OpenAI.Backend, cfg.OpenAI.Model = "chat", "" }, "OPENAI_MODEL is required with OPENAI_BACKEND=chat"},
+		"chat":           {func(cfg *config.Config) { cfg.OpenAI.Backend, cfg.OpenAI.AssistantId = "chat", "" }, ""},
+		"local key":      {func(cfg *config.Config) { cfg.OpenAI.Backend, cfg.OpenAI.ApiKey = "local", "" }, ""},
+		"api type":       {func(cfg *config.Config) { cfg.OpenAI.ApiType = "bedrock" }, `OPENAI_API_TYPE must be one of openai, azure, got "bedrock"`},
+		"azure version":  {func(cfg *config.Config) { cfg.OpenAI.ApiType, cfg.OpenAI.ApiVersion = "azure", "" }, "OPENAI_API_VERSION is required"},
+		"history source": {func(cfg *config.Config) { cfg.History.Source = "database" }, `HISTORY_SOURCE must be one of store, slack, got "database"`},
+		"prices":         {func(cfg *config.Config) { cfg.Usage.Prices = []string{"gpt-4o=5"} }, `USAGE_PRICES: invalid price "gpt-4o=5"`},
+
+		"oauth": {func(cfg *config.Config) { cfg.Slack.ClientId, cfg.Slack.BotToken = "123.456", "" }, "SLACK_CLIENT_SECRET is required"},
+		"oauth complete": {func(cfg *config.Config) {
+			cfg.Slack.ClientId, cfg.Slack.ClientSecret, cfg.Slack.BotToken = "123.456", "secret", ""
+			cfg.Slack.RedirectUrl = "https://example.com/slack/oauth_redirect"
+		}, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid()
+			test.configure(cfg)
+
+			err := cfg.Validate()
+
+			switch {
+			case test.want == "" && err != nil:
+				t.Fatalf("expected valid, got %v", err)
+			case test.want != "" && err == nil:
+				t.Fatalf("expected %q", test.want)
+			case test.want != "" && !strings.Contains(err.Error(), test.want):
+				t.Fatalf("expected %q in %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfg := valid()
+	cfg.Port = ""
+	cfg.Slack.Transport = "grpc"
+	cfg.OpenAI.RunTimeout = 0
+
+	err := cfg.Validate()
+
+	var errs config.Errors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", err)
+	}
+}
+
+func TestValidateOpenAIIgnoresSlack(t *testing.T) {
+	cfg := config.Default()
+	cfg.OpenAI.ApiKey = "sk-test"
+
+	if err := cfg.ValidateOpenAI(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.OpenAI.ApiUrl = ""
+	if err := cfg.ValidateOpenAI(); err == nil || !strings.Contains(err.Error(), "OPENAI_API_URL is required") {
+		t.Fatalf("expected missing url, got %v", err)
+	}
+}
+
+func TestParsePrices(t *testing.T) {
+	prices, err := config.ParsePrices([]string{"gpt-4o=5/15", "gpt-4o-mini=0.15/0.6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]config.Price{"gpt-4o": {Input: 5, Output: 15}, "gpt-4o-mini": {Input: 0.15, Output: 0.6}}
+	if !reflect.DeepEqual(prices, want) {
+		t.Fatalf("expected %v, got %v", want, prices)
+	}
+
+	for _, invalid := range []string{"gpt-4o", "=5/15", "gpt-4o=five/15", "gpt-4o=5/fifteen"} {
+		if _, err := config.ParsePrices([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package router
+
+import (
+	"context"
+	"io"
+
+	"github.com/dominikwinter/slackgpt/internal/chat"
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+)
+
+// SlackAPI is the part of slack.Client the router uses.
+type SlackAPI interface {
+	StartThread(ctx context.Context, text, channel, threadTs, aiThreadId string) (*slack.I, error)
+	UpdateThread(ctx context.Context, text, channel, ts, aiThreadId string) (*slack.I, error)
+	AddToThread(ctx context.Context, text, channel, threadTs string) (*slack.I, error)
+	UpdateMessage(ctx context.Context, text, channel, ts string) (*slack.I, error)
+	DeleteMessage(ctx context.Context, channel, ts string) (*slack.I, error)
+	GetHistory(ctx context.Context, channel, threadTs string, limit int) (*slack.History, error)
+	DownloadFile(ctx context.Context, url string) (io.ReadCloser, error)
+	AddReactions(ctx context.Context, channel, name, timestamp string) (*slack.I, error)
+	DelReactions(ctx context.Context, channel, name, timestamp string) (*slack.I, error)
+	OAuthAccess(ctx context.Context, clientId, clientSecret, code, redirectUrl string) (*slack.OAuthAccess, error)
+}
+
+// Provider answers messages in conversations identified by thread ids. It is
+// implemented by openai.Client with the Assistants API and by chat.Provider
+// with the Chat Completions API.
+type Provider interface {
+	CreateThread(ctx context.Context) (*openai.Thread, error)
+	SendMessageAndWaitForAnswer(ctx context.Context, threadId, content string, attachments ...openai.Attachment) (*openai.Answer, error)
+	SendMessageAndStreamAnswer(ctx context.Context, threadId, content string, onDelta func(text string), attachments ...openai.Attachment) (*openai.Answer, error)
+	UploadFile(ctx context.Context, purpose, fileName string, file io.Reader) (*openai.File, error)
+}
+
+var _ SlackAPI = (*slack.Client)(nil)
+var _ Provider = (*openai.Client)(nil)
+var _ Provider = (*chat.Provider)(nil)
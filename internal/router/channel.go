@@ -0,0 +1,95 @@
+package router
+
+import (
+	"regexp"
+	"strings"
+)
+
+// How the bot reacts to messages, configurable per channel type.
+const (
+	// answer every message
+	ModeAll = "all"
+	// answer mentions and every reply in threads the bot takes part in
+	ModeThread = "thread"
+	// answer mentions only
+	ModeMention = "mention"
+	// ignore the channel type
+	ModeOff = "off"
+)
+
+// https://api.slack.com/events/message#channel_types
+func channelType(event *Event) string {
+	if event.ChannelType != "" {
+		return event.ChannelType
+	}
+
+	// app_mention events don't carry a channel_type, guess from the id
+	switch {
+	case strings.HasPrefix(event.Channel, "D"):
+		return "im"
+	case strings.HasPrefix(event.Channel, "G"):
+		return "group"
+	default:
+		return "channel"
+	}
+}
+
+// accepts decides by the mode of the channel type whether the bot answers the
+// event. Mentions arrive twice, as message and as app_mention, the second one
+// is dropped by isDuplicateMessage.
+func (h *Handler) accepts(event *Event) bool {
+	mode, ok := h.ChannelModes[channelType(event)]
+	if !ok {
+		mode = ModeMention
+	}
+
+	switch mode {
+	case ModeAll:
+		return true
+	case ModeThread:
+		return event.Type == "app_mention" || h.inThread(event)
+	case ModeMention:
+		return event.Type == "app_mention"
+	default:
+		return false
+	}
+}
+
+// inThread reports whether the event is a reply in a thread the bot started.
+func (h *Handler) inThread(event *Event) bool {
+	if event.ThreadTs == "" {
+		return false
+	}
+
+	aiThreadId, err := h.Threads.GetThread(event.Channel, event.ThreadTs)
+	if err != nil {
+		h.Log.Error("Failed to get thread", "error", err)
+		return false
+	}
+
+	return aiThreadId != ""
+}
+
+// stripMention removes mentions of the bot, so the assistant doesn't mistake
+// the bot for the feedback receiver.
+func stripMention(text, botUserId string) string {
+	if botUserId == "" {
+		return text
+	}
+
+	mention := regexp.MustCompile(`\s*<@` + regexp.QuoteMeta(botUserId) + `(\|[^>]*)?>\s*`)
+
+	return strings.TrimSpace(mention.ReplaceAllString(text, " "))
+}
+
+// botUserId returns the user id of the bot in the workspace of the event.
+// https://api.slack.com/apis/connections/events-api#authorizations
+func (body *SlackRequestBody) botUserId() string {
+	for _, authorization := range body.Authorizations {
+		if authorization.IsBot {
+			return authorization.UserId
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"expvar"
+)
+
+// exposed on /debug/vars
+var (
+	eventsRetried    = expvar.NewInt("slack_events_retried")
+	eventsDuplicated = expvar.NewInt("slack_events_duplicates_dropped")
+)
+
+// isDuplicate reports whether the event has already been processed, e.g. it
+// is a retry because we were too slow to acknowledge the first delivery.
+func (h *Handler) isDuplicate(body *SlackRequestBody, retryNum, retryReason string) bool {
+	if retryNum != "" && retryNum != "0" {
+		eventsRetried.Add(1)
+
+		h.Log.Info("Slack retried event",
+			"event_id", body.EventId,
+			"retry_num", retryNum,
+			"retry_reason", retryReason,
+		)
+	}
+
+	if body.EventId == "" {
+		return false
+	}
+
+	return h.markProcessed(body.EventId)
+}
+
+// isDuplicateMessage reports whether the message has already been processed
+// by another event, mentions are delivered as message and app_mention with
+// different event ids.
+func (h *Handler) isDuplicateMessage(event *Event) bool {
+	return h.markProcessed(messageKey(event))
+}
+
+func messageKey(event *Event) string {
+	return "message/" + event.Channel + "/" + event.Ts
+}
+
+func (h *Handler) markProcessed(id string) bool {
+	seen, err := h.Events.MarkProcessed(id, h.EventTtl)
+	if err != nil {
+		// rather answer twice than not at all
+		h.Log.Error("Failed to mark event as processed", "event_id", id, "error", err)
+		return false
+	}
+
+	if seen {
+		eventsDuplicated.Add(1)
+		h.Log.Info("Dropping duplicate event", "event_id", id)
+	}
+
+	return seen
+}
+
+// forget removes the marks of an event which wasn't accepted, so Slack's
+// retry is processed instead of dropped as duplicate.
+func (h *Handler) forget(ids ...string) {
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+
+		if err := h.Events.Forget(id); err != nil {
+			h.Log.Error("Failed to forget event", "event_id", id, "error", err)
+		}
+	}
+}
@@ -1,121 +1,237 @@
 package router
 
 import (
+	"context"
 	"fmt"
-	"log/slog"
-	"os"
 
-	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/chat"
 	"github.com/dominikwinter/slackgpt/internal/client/slack"
 	"github.com/dominikwinter/slackgpt/pkg/fiber/middleware/slacksignature"
 	"github.com/gofiber/fiber/v3"
 )
 
 type SlackRequestBody struct {
-	Type      string `json:"type"`
-	Challenge string `json:"challenge"`
-	Event     *Event `json:"event"`
+	Type           string          `json:"type"`
+	Challenge      string          `json:"challenge"`
+	TeamId         string          `json:"team_id"`
+	EventId        string          `json:"event_id"`
+	EventTime      int64           `json:"event_time"`
+	Event          *Event          `json:"event"`
+	Authorizations []Authorization `json:"authorizations"`
+}
+
+type Authorization struct {
+	TeamId string `json:"team_id"`
+	UserId string `json:"user_id"`
+	IsBot  bool   `json:"is_bot"`
 }
 
 type Event struct {
 	Type        string       `json:"type"`
 	Ts          string       `json:"ts"`
 	Channel     string       `json:"channel"`
+	ChannelType string       `json:"channel_type"`
 	ThreadTs    string       `json:"thread_ts"`
 	EventTs     string       `json:"event_ts"`
 	User        string       `json:"user"`
 	BotId       string       `json:"bot_id"`
 	Text        string       `json:"text"`
 	UserProfile *UserProfile `json:"user_profile"`
+	Subtype     string       `json:"subtype"`
+	Team        string       `json:"team"`
+	Files       []slack.File `json:"files"`
+	// message_changed and message_deleted
+	// https://api.slack.com/events/message#hidden_subtypes
+	Message         *Event `json:"message"`
+	PreviousMessage *Event `json:"previous_message"`
+	DeletedTs       string `json:"deleted_ts"`
+	// of the request, to tell the bot's messages in the thread apart
+	BotUserId string `json:"-"`
 }
 
 type UserProfile struct {
 	RealName string `json:"real_name"`
 }
 
-var slackAiThreadMap = map[string]string{}
 var DEFAULT_ERROR_MESSAGE = ":exploding_head: Sorry, sometimes i'm forgetful. Please start another thread."
 
-var slackClient = slack.New(os.Getenv("SLACK_API_URL"), os.Getenv("SLACK_BOT_TOKEN"))
-var openaiClient = openai.New(os.Getenv("OPENAI_API_URL"), os.Getenv("OPENAI_API_KEY"), os.Getenv("OPENAI_ORGANIZATION"))
+func (h *Handler) chat(ctx context.Context, event *Event) error {
+	if h.limited(ctx, event) {
+		return nil
+	}
+
+	ctx = withSlackThread(ctx, event)
 
-func initChat(event *Event) error {
-	_, err := slackClient.AddReactions(event.Channel, "thinking", event.Ts)
+	if len(event.ThreadTs) == 0 || (event.Type == "app_mention" && !h.inThread(event)) {
+		// direct message or mention, not in a thread of ours, init chat
+		return h.initChat(ctx, event)
+	}
+
+	// if message is from user and we are in the thread .. so it's obviously the second message.
+	return h.replyChat(ctx, event)
+}
+
+func (h *Handler) initChat(ctx context.Context, event *Event) error {
+	// error messages and reaction removal must happen even if ctx is done
+	cleanup := context.WithoutCancel(ctx)
+
+	// a mention inside a foreign thread continues there
+	threadTs := event.Ts
+	if event.ThreadTs != "" {
+		threadTs = event.ThreadTs
+	}
+
+	_, err := h.Slack.AddReactions(ctx, event.Channel, "thinking", event.Ts)
 	if err != nil {
 		return fmt.Errorf("failed to add reaction: %w", err)
 	}
-	defer slackClient.DelReactions(event.Channel, "thinking", event.Ts)
+	defer h.Slack.DelReactions(cleanup, event.Channel, "thinking", event.Ts)
 
-	openAiThread, err := openaiClient.CreateThread()
+	openAiThread, err := h.Provider.CreateThread(ctx)
 	if err != nil {
-		slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.Ts)
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, threadTs)
 		return fmt.Errorf("failed to create thread: %w", err)
 	}
 
-	slackAiThreadMap[event.Ts] = openAiThread.Id
+	if err := h.Threads.SetThread(event.Channel, threadTs, openAiThread.Id); err != nil {
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, threadTs)
+		return fmt.Errorf("failed to store thread: %w", err)
+	}
 
 	message := fmt.Sprintf(`
 		Parse the "Text" and extract the name of the colleague as feedback receiver. The name is in the format like <@U069DBU1TGQ>.
+		Use the function get_slack_user to look up the colleague's real name, title and time zone and address them by their real name.
 		If you can't find a name, please ask the user to provide the name of the colleague.
 		After that start with the questionnaire.
 
+		User: <@%s>
+		Channel: %s
 		Text: %s
-	`, event.Text)
+	`, event.User, event.Channel, event.Text)
+
+	attachments := h.attachFiles(ctx, event, threadTs)
 
-	openAiAnswer, err := openaiClient.SendMessageAndWaitForAnswer(openAiThread.Id, message)
+	if h.Streaming {
+		ts, openAiAnswer, err := h.streamAnswer(ctx, event.Channel, threadTs, openAiThread.Id, message, attachments...)
+		if err != nil {
+			return err
+		}
+
+		h.recordUsage(event, openAiAnswer)
+
+		if _, err := h.Slack.UpdateThread(ctx, openAiAnswer.Text, event.Channel, ts, openAiThread.Id); err != nil {
+			return fmt.Errorf("failed to update thread: %w", err)
+		}
+
+		h.rememberReply(event.Channel, threadTs, event.Ts, ts)
+
+		return nil
+	}
+
+	openAiAnswer, err := h.Provider.SendMessageAndWaitForAnswer(ctx, openAiThread.Id, message, attachments...)
 	if err != nil {
-		slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.Ts)
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, threadTs)
 		return fmt.Errorf("failed to send message and wait for answer: %w", err)
 	}
 
-	if _, err := slackClient.StartThread(openAiAnswer, event.Channel, event.Ts, openAiThread.Id); err != nil {
-		slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.Ts)
+	h.recordUsage(event, openAiAnswer)
+
+	res, err := h.Slack.StartThread(ctx, openAiAnswer.Text, event.Channel, threadTs, openAiThread.Id)
+	if err != nil {
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, threadTs)
 		return fmt.Errorf("failed to start thread: %w", err)
 	}
 
+	h.rememberReply(event.Channel, threadTs, event.Ts, messageTs(res))
+
 	return nil
 }
 
-func replyChat(event *Event) error {
-	openAiThreadId := slackAiThreadMap[event.ThreadTs]
+func (h *Handler) replyChat(ctx context.Context, event *Event) error {
+	cleanup := context.WithoutCancel(ctx)
 
-	// in case of restart `slackAiThreadMap` is of course empty, so we need to
-	// get the aiThreadId from the slack history.
+	openAiThreadId, err := h.Threads.GetThread(event.Channel, event.ThreadTs)
+	if err != nil {
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, event.Ts)
+		return fmt.Errorf("failed to get thread: %w", err)
+	}
+
+	// threads started before the store existed (or with the in-memory store
+	// after a restart) are unknown, so we need to get the aiThreadId from the
+	// slack history.
 	if openAiThreadId == "" {
 		// get second message from thread
-		history, err := slackClient.GetHistory(event.Channel, event.ThreadTs, 1)
+		history, err := h.Slack.GetHistory(ctx, event.Channel, event.ThreadTs, 1)
 		if err != nil {
-			slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.Ts)
+			h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, event.Ts)
 			return fmt.Errorf("failed to get history: %w", err)
 		}
 
 		openAiThreadId = getOpenAiThreadIdFromSecondMessageFromThread(history)
 		if openAiThreadId == "" {
-			slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.ThreadTs)
+			h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, event.ThreadTs)
 			return fmt.Errorf("failed to get openAiThreadId from second message from thread")
 		}
 
 		openAiThreadId = "thread_" + openAiThreadId
-		slackAiThreadMap[event.ThreadTs] = openAiThreadId
+
+		if err := h.Threads.SetThread(event.Channel, event.ThreadTs, openAiThreadId); err != nil {
+			return fmt.Errorf("failed to store thread: %w", err)
+		}
 	}
 
-	slackClient.AddReactions(event.Channel, "thinking", event.Ts)
-	defer slackClient.DelReactions(event.Channel, "thinking", event.Ts)
+	h.Slack.AddReactions(ctx, event.Channel, "thinking", event.Ts)
+	defer h.Slack.DelReactions(cleanup, event.Channel, "thinking", event.Ts)
+
+	attachments := h.attachFiles(ctx, event, event.Ts)
+
+	if h.Streaming {
+		ts, openAiAnswer, err := h.streamAnswer(ctx, event.Channel, event.Ts, openAiThreadId, event.Text, attachments...)
+		if err != nil {
+			return err
+		}
+
+		h.recordUsage(event, openAiAnswer)
+
+		if _, err := h.Slack.UpdateMessage(ctx, openAiAnswer.Text, event.Channel, ts); err != nil {
+			return fmt.Errorf("failed to update message: %w", err)
+		}
+
+		h.rememberReply(event.Channel, event.ThreadTs, event.Ts, ts)
 
-	openAiAnswer, err := openaiClient.SendMessageAndWaitForAnswer(openAiThreadId, event.Text)
+		return nil
+	}
+
+	openAiAnswer, err := h.Provider.SendMessageAndWaitForAnswer(ctx, openAiThreadId, event.Text, attachments...)
 	if err != nil {
-		slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.Ts)
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, event.Ts)
 		return fmt.Errorf("failed to send message and wait for answer: %w", err)
 	}
 
-	if _, err := slackClient.AddToThread(openAiAnswer, event.Channel, event.Ts); err != nil {
-		slackClient.AddToThread(DEFAULT_ERROR_MESSAGE, event.Channel, event.Ts)
+	h.recordUsage(event, openAiAnswer)
+
+	res, err := h.Slack.AddToThread(ctx, openAiAnswer.Text, event.Channel, event.Ts)
+	if err != nil {
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, event.Ts)
 		return fmt.Errorf("failed to start thread: %w", err)
 	}
 
+	h.rememberReply(event.Channel, event.ThreadTs, event.Ts, messageTs(res))
+
 	return nil
 }
 
+// withSlackThread lets the chat backend read the conversation up to the event
+// from Slack
+func withSlackThread(ctx context.Context, event *Event) context.Context {
+	threadTs := event.ThreadTs
+	if threadTs == "" {
+		threadTs = event.Ts
+	}
+
+	return chat.ContextWithSlackThread(ctx, chat.SlackThread{Channel: event.Channel, ThreadTs: threadTs, Ts: event.Ts, BotUserId: event.BotUserId})
+}
+
 // JS: history.messages?.[1]?.blocks?.at(-1)?.elements?.[0]?.text
 func getOpenAiThreadIdFromSecondMessageFromThread(history *slack.History) string {
 	if len(history.Messages) > 1 {
@@ -135,12 +251,28 @@ func getOpenAiThreadIdFromSecondMessageFromThread(history *slack.History) string
 	return ""
 }
 
-func Setup(app *fiber.App, log *slog.Logger) {
+// messages without thread_ts start a new thread, so their own ts is the key
+func conversationKey(event *Event) string {
+	if event.ThreadTs != "" {
+		return event.Channel + "/" + event.ThreadTs
+	}
+
+	return event.Channel + "/" + event.Ts
+}
+
+// Setup registers the events endpoint. In-flight events outlive ctx, use
+// Shutdown to drain them.
+func (h *Handler) Setup(ctx context.Context, app *fiber.App, signingSecret string) {
+	ctx = h.lifecycle.start(ctx)
+
+	signature := slacksignature.ConfigDefault
+	signature.Key = signingSecret
+
+	// registered before the route, so no unsigned request reaches it
+	app.Use("/api/v1/events", slacksignature.New(signature))
+
 	app.Post(
 		"/api/v1/events",
-		slacksignature.New(slacksignature.Config{
-			Key: os.Getenv("SLACK_SIGNING_SECRET"),
-		}),
 		func(c fiber.Ctx) error {
 			c.Response().Header.SetContentType("plain/text; charset=utf-8")
 
@@ -150,40 +282,139 @@ func Setup(app *fiber.App, log *slog.Logger) {
 				return err
 			}
 
-			log.Info("Incoming Request", "body", body)
+			h.Log.Info("Incoming Request", "body", body)
 
 			// url body request, used only once on app configuration in slack
 			// https://api.slackClient.com/apps/xxxxxx/event-subscriptions
 			// https://api.slackClient.com/apis/connections/events-api#handshake
 			if body.Type == "url_verification" {
-				log.Info("Responding to url verification", "challenge", body.Challenge)
+				h.Log.Info("Responding to url verification", "challenge", body.Challenge)
 				return c.SendString(body.Challenge)
 			}
 
-			if body.Type != "event_callback" ||
-				body.Event == nil ||
-				body.Event.Type != "message" ||
-				body.Event.BotId != "" ||
-				body.Event.UserProfile == nil {
-				return c.SendString("ok")
+			if !h.Dispatch(ctx, &body, c.Get("X-Slack-Retry-Num"), c.Get("X-Slack-Retry-Reason")) {
+				// slack retries the delivery, hopefully to a replica which isn't
+				// shutting down
+				return c.SendStatus(fiber.StatusServiceUnavailable)
 			}
 
-			go func() {
-				var err error
+			return c.SendString("ok")
+		},
+	)
+}
 
-				if len(body.Event.ThreadTs) == 0 {
-					// direct message, not in thread, init chat
-					err = initChat(body.Event)
-				} else {
-					// if message is from user and we are in the thread .. so it's obviously the second message.
-					err = replyChat(body.Event)
-				}
+// Dispatch filters an incoming event and queues it for processing. It is the
+// common path for the HTTP endpoint and Socket Mode. Returns false if the
+// event was rejected because of Shutdown.
+func (h *Handler) Dispatch(ctx context.Context, body *SlackRequestBody, retryNum, retryReason string) bool {
+	if h.lifecycle.isDraining() {
+		return false
+	}
 
-				if err != nil {
-					log.Error("Failed to process event", "error", err)
-				}
-			}()
+	if body.Type == "event_callback" && h.isDuplicate(body, retryNum, retryReason) {
+		return true
+	}
 
-			return c.SendString("ok")
-		})
+	if h.dispatch(ctx, body) {
+		return true
+	}
+
+	h.forget(body.EventId)
+
+	return false
+}
+
+// dispatch routes an event which isn't a duplicate, see Dispatch.
+func (h *Handler) dispatch(ctx context.Context, body *SlackRequestBody) bool {
+	if body.Type == "event_callback" && body.Event != nil && body.Event.Type == "app_uninstalled" {
+		h.uninstall(body.TeamId)
+		return true
+	}
+
+	if body.Type != "event_callback" || body.Event == nil {
+		return true
+	}
+
+	event := body.Event
+
+	switch {
+	case event.Type == "message" && event.Subtype == "message_changed":
+		edited := editedMessage(event)
+		if edited == nil {
+			return true
+		}
+
+		edited.Text = stripMention(edited.Text, body.botUserId())
+		edited.BotUserId = body.botUserId()
+
+		return h.enqueue(ctx, body.TeamId, edited, h.editChat)
+
+	case event.Type == "message" && event.Subtype == "message_deleted":
+		return h.enqueue(ctx, body.TeamId, deletedMessage(event), h.deleteChat)
+	}
+
+	if (event.Type != "message" && event.Type != "app_mention") ||
+		(event.Subtype != "" && event.Subtype != "file_share" && event.Subtype != "thread_broadcast") ||
+		event.BotId != "" ||
+		event.User == "" {
+		return true
+	}
+
+	if !h.accepts(event) || h.isDuplicateMessage(event) {
+		return true
+	}
+
+	event.Text = stripMention(event.Text, body.botUserId()) + describeFiles(event.Files)
+	event.BotUserId = body.botUserId()
+
+	if h.enqueue(ctx, body.TeamId, event, h.chat) {
+		return true
+	}
+
+	h.forget(messageKey(event))
+
+	return false
+}
+
+// enqueue processes the event in the queue of its conversation with the bot
+// token of its workspace. Returns false if the event was rejected because of
+// Shutdown.
+func (h *Handler) enqueue(ctx context.Context, teamId string, event *Event, process func(ctx context.Context, event *Event) error) bool {
+	if !h.lifecycle.acquire() {
+		return false
+	}
+
+	h.conversations.Push(conversationKey(event), func() {
+		defer h.lifecycle.release()
+
+		ctx, cancel := context.WithTimeout(ctx, h.EventTimeout)
+		defer cancel()
+
+		// limits are counted per workspace, not every event carries it
+		if event.Team == "" {
+			event.Team = teamId
+		}
+
+		ctx, err := h.withInstallation(ctx, teamId)
+		if err != nil {
+			h.Log.Error("Failed to process event", "error", err)
+			return
+		}
+
+		// cancelled while waiting in the queue, nobody waits for an answer
+		// to a deleted message
+		if ctx.Err() != nil {
+			if event.Subtype != "message_deleted" {
+				h.Slack.AddToThread(context.WithoutCancel(ctx), h.errorMessage(ctx), event.Channel, event.Ts)
+			}
+			h.Log.Error("Failed to process event", "error", context.Cause(ctx))
+			return
+		}
+
+		if err := process(ctx, event); err != nil {
+			h.Log.Error("Failed to process event", "error", err)
+		}
+	})
+
+	return true
 }
@@ -0,0 +1,111 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/router"
+)
+
+type Message struct {
+	ThreadId    string
+	Content     string
+	Attachments []openai.Attachment
+}
+
+// File is an uploaded file.
+type File struct {
+	Id       string
+	Purpose  string
+	FileName string
+	Content  string
+}
+
+// Assistant answers with Answer, by default it echoes the message. It is safe
+// for concurrent use.
+type Assistant struct {
+	mu       sync.Mutex
+	threads  int
+	messages []Message
+	files    []File
+
+	Answer func(ctx context.Context, threadId, content string) (string, error)
+	// reported for every answer
+	Usage openai.Usage
+}
+
+func (a *Assistant) Messages() []Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]Message(nil), a.messages...)
+}
+
+func (a *Assistant) Files() []File {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]File(nil), a.files...)
+}
+
+func (a *Assistant) CreateThread(ctx context.Context) (*openai.Thread, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.threads++
+
+	return &openai.Thread{Id: fmt.Sprintf("thread_%d", a.threads)}, nil
+}
+
+func (a *Assistant) SendMessageAndWaitForAnswer(ctx context.Context, threadId, content string, attachments ...openai.Attachment) (*openai.Answer, error) {
+	a.mu.Lock()
+	a.messages = append(a.messages, Message{ThreadId: threadId, Content: content, Attachments: attachments})
+	answer, usage := a.Answer, a.Usage
+	a.mu.Unlock()
+
+	if answer == nil {
+		return &openai.Answer{Text: "echo: " + strings.TrimSpace(content), Usage: usage}, nil
+	}
+
+	text, err := answer(ctx, threadId, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openai.Answer{Text: text, Usage: usage}, nil
+}
+
+// SendMessageAndStreamAnswer passes the answer word by word to onDelta.
+func (a *Assistant) SendMessageAndStreamAnswer(ctx context.Context, threadId, content string, onDelta func(text string), attachments ...openai.Attachment) (*openai.Answer, error) {
+	answer, err := a.SendMessageAndWaitForAnswer(ctx, threadId, content, attachments...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, word := range strings.SplitAfter(answer.Text, " ") {
+		onDelta(word)
+	}
+
+	return answer, nil
+}
+
+func (a *Assistant) UploadFile(ctx context.Context, purpose, fileName string, file io.Reader) (*openai.File, error) {
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f := File{Id: fmt.Sprintf("file_%d", len(a.files)+1), Purpose: purpose, FileName: fileName, Content: string(b)}
+	a.files = append(a.files, f)
+
+	return &openai.File{Id: f.Id, Filename: fileName, Purpose: purpose, Bytes: len(b)}, nil
+}
+
+var _ router.Provider = (*Assistant)(nil)
@@ -0,0 +1,171 @@
+// Package fake provides in-memory implementations of the router's SlackAPI
+// and Provider, so the event flow can be exercised without credentials.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/router"
+)
+
+// Post is a message the bot posted or updated.
+type Post struct {
+	// chat.postMessage, chat.update or chat.delete
+	Method     string
+	Channel    string
+	ThreadTs   string
+	Ts         string
+	Text       string
+	AiThreadId string
+}
+
+type Reaction struct {
+	// reactions.add or reactions.remove
+	Method    string
+	Channel   string
+	Name      string
+	Timestamp string
+}
+
+// Slack records everything the bot sends. It is safe for concurrent use.
+type Slack struct {
+	mu        sync.Mutex
+	posts     []Post
+	reactions []Reaction
+	ts        int
+
+	// returned by GetHistory
+	History *slack.History
+	// returned by OAuthAccess
+	OAuth *slack.OAuthAccess
+	// returned by DownloadFile by url
+	Files map[string]string
+	// returned by every method if set
+	Err error
+}
+
+func (s *Slack) Posts() []Post {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Post(nil), s.posts...)
+}
+
+func (s *Slack) Reactions() []Reaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Reaction(nil), s.reactions...)
+}
+
+func (s *Slack) post(post Post) (*slack.I, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	if post.Ts == "" {
+		s.ts++
+		post.Ts = fmt.Sprintf("2000000000.%06d", s.ts)
+	}
+
+	s.posts = append(s.posts, post)
+
+	return &slack.I{"ok": true, "channel": post.Channel, "ts": post.Ts}, nil
+}
+
+func (s *Slack) react(reaction Reaction) (*slack.I, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	s.reactions = append(s.reactions, reaction)
+
+	return &slack.I{"ok": true}, nil
+}
+
+func (s *Slack) StartThread(ctx context.Context, text, channel, threadTs, aiThreadId string) (*slack.I, error) {
+	return s.post(Post{Method: "chat.postMessage", Channel: channel, ThreadTs: threadTs, Text: text, AiThreadId: aiThreadId})
+}
+
+func (s *Slack) UpdateThread(ctx context.Context, text, channel, ts, aiThreadId string) (*slack.I, error) {
+	return s.post(Post{Method: "chat.update", Channel: channel, Ts: ts, Text: text, AiThreadId: aiThreadId})
+}
+
+func (s *Slack) AddToThread(ctx context.Context, text, channel, threadTs string) (*slack.I, error) {
+	return s.post(Post{Method: "chat.postMessage", Channel: channel, ThreadTs: threadTs, Text: text})
+}
+
+func (s *Slack) UpdateMessage(ctx context.Context, text, channel, ts string) (*slack.I, error) {
+	return s.post(Post{Method: "chat.update", Channel: channel, Ts: ts, Text: text})
+}
+
+func (s *Slack) DeleteMessage(ctx context.Context, channel, ts string) (*slack.I, error) {
+	return s.post(Post{Method: "chat.delete", Channel: channel, Ts: ts})
+}
+
+func (s *Slack) GetHistory(ctx context.Context, channel, threadTs string, limit int) (*slack.History, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	if s.History == nil {
+		return &slack.History{}, nil
+	}
+
+	return s.History, nil
+}
+
+func (s *Slack) DownloadFile(ctx context.Context, url string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	content, ok := s.Files[url]
+	if !ok {
+		return nil, fmt.Errorf("failed to download file: 404 Not Found")
+	}
+
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+func (s *Slack) AddReactions(ctx context.Context, channel, name, timestamp string) (*slack.I, error) {
+	return s.react(Reaction{Method: "reactions.add", Channel: channel, Name: name, Timestamp: timestamp})
+}
+
+func (s *Slack) DelReactions(ctx context.Context, channel, name, timestamp string) (*slack.I, error) {
+	return s.react(Reaction{Method: "reactions.remove", Channel: channel, Name: name, Timestamp: timestamp})
+}
+
+func (s *Slack) OAuthAccess(ctx context.Context, clientId, clientSecret, code, redirectUrl string) (*slack.OAuthAccess, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	if s.OAuth == nil {
+		return &slack.OAuthAccess{Error: "invalid_code"}, nil
+	}
+
+	return s.OAuth, nil
+}
+
+var _ router.SlackAPI = (*Slack)(nil)
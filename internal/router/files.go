@@ -0,0 +1,125 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+)
+
+var FILES_SKIPPED_MESSAGE = ":warning: I can't read %s, only %s up to %d MB."
+
+var errFileTooLarge = errors.New("file is larger than announced")
+
+// attachFiles streams the files shared with the event from Slack to OpenAI,
+// so the assistant can search them or, for images, look at them. Files
+// breaking the limits or failing to transfer are skipped and the user is told
+// so.
+func (h *Handler) attachFiles(ctx context.Context, event *Event, threadTs string) []openai.Attachment {
+	if h.FileMaxSize <= 0 || len(event.Files) == 0 {
+		return nil
+	}
+
+	var attachments []openai.Attachment
+	var skipped []string
+
+	for _, file := range event.Files {
+		// https://platform.openai.com/docs/guides/vision
+		purpose, attach := "assistants", openai.FileSearch
+		if matchMimeType(h.ImageMimeTypes, file.Mimetype) {
+			purpose, attach = "vision", openai.ImageFile
+		} else if !matchMimeType(h.FileMimeTypes, file.Mimetype) {
+			skipped = append(skipped, file.Name)
+			continue
+		}
+
+		if int64(file.Size) > h.FileMaxSize {
+			skipped = append(skipped, file.Name)
+			continue
+		}
+
+		uploaded, err := h.uploadFile(ctx, file, purpose)
+		if err != nil {
+			h.Log.Error("Failed to forward file", "error", err, "file", file.Id)
+			skipped = append(skipped, file.Name)
+			continue
+		}
+
+		attachments = append(attachments, attach(uploaded.Id))
+	}
+
+	if len(skipped) > 0 {
+		mimeTypes := append(append([]string(nil), h.FileMimeTypes...), h.ImageMimeTypes...)
+		text := fmt.Sprintf(FILES_SKIPPED_MESSAGE, strings.Join(skipped, ", "), strings.Join(mimeTypes, ", "), h.FileMaxSize>>20)
+		h.Slack.AddToThread(ctx, text, event.Channel, threadTs)
+	}
+
+	return attachments
+}
+
+func (h *Handler) uploadFile(ctx context.Context, file slack.File, purpose string) (*openai.File, error) {
+	body, err := h.Slack.DownloadFile(ctx, file.UrlPrivate)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	// the announced size is checked already, this guards against lies. The
+	// upload ignores read errors, so the reader cancels it.
+	limit := h.FileMaxSize
+	if file.Size > 0 {
+		limit = min(int64(file.Size), limit)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	uploaded, err := h.Provider.UploadFile(ctx, purpose, file.Name, &sizeLimitReader{r: body, n: limit, cancel: cancel})
+	if errors.Is(context.Cause(ctx), errFileTooLarge) {
+		return nil, errFileTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	return uploaded, nil
+}
+
+// sizeLimitReader fails and cancels once more than n bytes are read, unlike
+// io.LimitReader, which ends early and would upload a truncated file
+type sizeLimitReader struct {
+	r      io.Reader
+	n      int64
+	cancel context.CancelCauseFunc
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+
+	if l.n < 0 {
+		l.cancel(errFileTooLarge)
+		return n, errFileTooLarge
+	}
+
+	return n, err
+}
+
+// matchMimeType matches exact types and wildcards like text/*
+func matchMimeType(patterns []string, mimeType string) bool {
+	for _, allowed := range patterns {
+		if allowed == mimeType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,248 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/blockkit"
+	"github.com/dominikwinter/slackgpt/internal/chat"
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/config"
+	"github.com/dominikwinter/slackgpt/internal/store"
+	"github.com/dominikwinter/slackgpt/internal/tools"
+)
+
+// Handler processes Slack events. Create it with New for production or
+// NewHandler to pass in fakes like the ones of package fake.
+type Handler struct {
+	Slack    SlackAPI
+	Provider Provider
+	Threads  store.ThreadStore
+	Events   store.EventStore
+	// the bot's answer to each question, for edits and deletions
+	Replies store.ReplyStore
+	// bot tokens of workspaces installed via OAuth, nil with a single workspace
+	Installations store.InstallationStore
+	// messages and tokens per user and workspace for Limits
+	Counters store.CounterStore
+	// tokens per month, team, user, channel and model for the usage report
+	Usage store.UsageStore
+	Log   *slog.Logger
+
+	// upper bound for processing a single event, including waiting for OpenAI
+	EventTimeout time.Duration
+	// processed event ids are remembered this long to drop retries
+	EventTtl time.Duration
+	// post a placeholder and edit it while the answer is generated
+	Streaming         bool
+	StreamingInterval time.Duration
+	// Mode* by channel type (im, mpim, channel, group)
+	ChannelModes map[string]string
+	// shared files up to FileMaxSize bytes and of FileMimeTypes are forwarded
+	// to the assistant, ImageMimeTypes as images. 0 disables forwarding.
+	FileMaxSize    int64
+	FileMimeTypes  []string
+	ImageMimeTypes []string
+	// rate limits, token and cost budgets, 0 disables a limit
+	Limits config.Limits
+	// by model for the cost budgets
+	Prices map[string]config.Price
+
+	// one queue per slack thread, OpenAI rejects new runs while one is active
+	conversations *queue
+	lifecycle     lifecycle
+}
+
+// NewHandler creates a handler with the timeouts of cfg and the given
+// dependencies.
+func NewHandler(cfg *config.Config, slackApi SlackAPI, provider Provider, threads store.ThreadStore, events store.EventStore, log *slog.Logger) *Handler {
+	// validated on start
+	prices, _ := config.ParsePrices(cfg.Usage.Prices)
+
+	return &Handler{
+		Slack:             slackApi,
+		Provider:          provider,
+		Threads:           threads,
+		Events:            events,
+		Replies:           store.NewMemoryReplyStore(),
+		Counters:          store.NewMemoryCounterStore(),
+		Usage:             store.NewMemoryUsageStore(),
+		Log:               log,
+		EventTimeout:      cfg.Events.Timeout,
+		EventTtl:          cfg.Events.DedupTtl,
+		Streaming:         cfg.Slack.Streaming,
+		StreamingInterval: cfg.Slack.StreamingInterval,
+		ChannelModes: map[string]string{
+			"im":      cfg.Slack.ChannelTypes.Im,
+			"mpim":    cfg.Slack.ChannelTypes.Mpim,
+			"channel": cfg.Slack.ChannelTypes.Channel,
+			"group":   cfg.Slack.ChannelTypes.Group,
+		},
+		FileMaxSize:    int64(cfg.Files.MaxSizeMb) << 20,
+		FileMimeTypes:  cfg.Files.MimeTypes,
+		ImageMimeTypes: cfg.Files.ImageMimeTypes,
+		Limits:         cfg.Limits,
+		Prices:         prices,
+		conversations:  newQueue(),
+	}
+}
+
+// New creates the clients and stores from cfg.
+func New(cfg *config.Config, log *slog.Logger) (*Handler, error) {
+	slackClient := slack.New(cfg.Slack.ApiUrl, cfg.Slack.BotToken)
+	openaiClient := newOpenaiClient(cfg.OpenAI, slackClient)
+
+	provider, err := newProvider(cfg, openaiClient, slackClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider: %w", err)
+	}
+
+	threads, err := newThreadStore(cfg.Threads.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create thread store: %w", err)
+	}
+
+	events, err := newEventStore(cfg.Events.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event store: %w", err)
+	}
+
+	handler := NewHandler(cfg, slackClient, provider, threads, events, log)
+
+	// the chat backends can't read files, they are only listed in the message
+	if cfg.OpenAI.Backend != "assistants" {
+		handler.FileMaxSize = 0
+	}
+
+	handler.Replies, err = newReplyStore(cfg.Replies.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reply store: %w", err)
+	}
+
+	handler.Counters, err = newCounterStore(cfg.Limits.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create counter store: %w", err)
+	}
+
+	handler.Usage, err = newUsageStore(cfg.Usage.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create usage store: %w", err)
+	}
+
+	if cfg.Slack.OAuth() {
+		handler.Installations, err = newInstallationStore(cfg.Installations.StorePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create installation store: %w", err)
+		}
+	}
+
+	return handler, nil
+}
+
+func newOpenaiClient(cfg config.OpenAI, slackClient *slack.Client) *openai.Client {
+	client := openai.NewFromConfig(cfg)
+
+	if cfg.Tools {
+		tools.RegisterSlack(client.Tools, slackClient)
+	}
+
+	return client
+}
+
+// newProvider selects the backend, assistants keep the conversation in OpenAI
+// threads, chat and local in the history store or read it from Slack.
+func newProvider(cfg *config.Config, client *openai.Client, slackClient *slack.Client) (Provider, error) {
+	if cfg.OpenAI.Backend == "assistants" {
+		return client, nil
+	}
+
+	history, err := newHistoryStore(cfg.History.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create history store: %w", err)
+	}
+
+	provider := &chat.Provider{
+		Client:       client,
+		Model:        cfg.OpenAI.Model,
+		Instructions: cfg.OpenAI.Instructions,
+		History:      history,
+		MaxMessages:  cfg.History.MaxMessages,
+	}
+
+	if cfg.History.Source == "slack" {
+		provider.Slack = &chat.SlackHistory{Slack: slackClient, MaxTokens: cfg.History.MaxTokens, Skip: systemMessages()}
+	}
+
+	return provider, nil
+}
+
+// systemMessages are posted by the bot instead of an answer, as Slack returns
+// them
+func systemMessages() []string {
+	var messages []string
+
+	for _, message := range []string{STREAMING_PLACEHOLDER, DEFAULT_ERROR_MESSAGE, SHUTDOWN_MESSAGE, RATE_LIMIT_MESSAGE, BUDGET_MESSAGE} {
+		messages = append(messages, blockkit.Text(message))
+	}
+
+	return messages
+}
+
+// without a path the mapping lives in memory only and is lost on restart
+func newThreadStore(path string) (store.ThreadStore, error) {
+	if path == "" {
+		return store.NewMemoryThreadStore(), nil
+	}
+
+	return store.NewFileThreadStore(path)
+}
+
+func newEventStore(path string) (store.EventStore, error) {
+	if path == "" {
+		return store.NewMemoryEventStore(), nil
+	}
+
+	return store.NewFileEventStore(path)
+}
+
+func newReplyStore(path string) (store.ReplyStore, error) {
+	if path == "" {
+		return store.NewMemoryReplyStore(), nil
+	}
+
+	return store.NewFileReplyStore(path)
+}
+
+func newInstallationStore(path string) (store.InstallationStore, error) {
+	if path == "" {
+		return store.NewMemoryInstallationStore(), nil
+	}
+
+	return store.NewFileInstallationStore(path)
+}
+
+func newCounterStore(path string) (store.CounterStore, error) {
+	if path == "" {
+		return store.NewMemoryCounterStore(), nil
+	}
+
+	return store.NewFileCounterStore(path)
+}
+
+func newUsageStore(path string) (store.UsageStore, error) {
+	if path == "" {
+		return store.NewMemoryUsageStore(), nil
+	}
+
+	return store.NewFileUsageStore(path)
+}
+
+func newHistoryStore(path string) (store.HistoryStore, error) {
+	if path == "" {
+		return store.NewMemoryHistoryStore(), nil
+	}
+
+	return store.NewFileHistoryStore(path)
+}
@@ -0,0 +1,129 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/config"
+	"github.com/dominikwinter/slackgpt/internal/store"
+	"github.com/gofiber/fiber/v3"
+)
+
+// the state parameter of the OAuth flow is bound to the browser by a cookie
+// https://api.slack.com/authentication/oauth-v2#asking
+const oauthStateCookie = "slack_oauth_state"
+
+// SetupOAuth registers the install flow which lets other workspaces add the
+// app. Their bot tokens end up in Installations, keyed by team id.
+// https://api.slack.com/authentication/oauth-v2
+func (h *Handler) SetupOAuth(app *fiber.App, cfg config.Slack) {
+	app.Get("/slack/install", func(c fiber.Ctx) error {
+		state := make([]byte, 16)
+		if _, err := rand.Read(state); err != nil {
+			return err
+		}
+
+		c.Cookie(&fiber.Cookie{
+			Name:     oauthStateCookie,
+			Value:    hex.EncodeToString(state),
+			Path:     "/slack",
+			MaxAge:   int((10 * time.Minute).Seconds()),
+			Secure:   strings.HasPrefix(cfg.RedirectUrl, "https://"),
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+
+		query := url.Values{
+			"client_id":    {cfg.ClientId},
+			"scope":        {strings.Join(cfg.Scopes, ",")},
+			"redirect_uri": {cfg.RedirectUrl},
+			"state":        {hex.EncodeToString(state)},
+		}
+
+		return c.Redirect().To(cfg.ApiUrl + "/oauth/v2/authorize?" + query.Encode())
+	})
+
+	app.Get("/slack/oauth_redirect", func(c fiber.Ctx) error {
+		c.Response().Header.SetContentType("plain/text; charset=utf-8")
+
+		// e.g. access_denied if the user cancelled
+		if reason := c.Query("error"); reason != "" {
+			return c.Status(fiber.StatusBadRequest).SendString("Installation cancelled: " + reason)
+		}
+
+		state := c.Cookies(oauthStateCookie)
+		c.ClearCookie(oauthStateCookie)
+
+		if state == "" || c.Query("state") != state {
+			return c.Status(fiber.StatusBadRequest).SendString("Installation expired, please start again.")
+		}
+
+		res, err := h.Slack.OAuthAccess(c.UserContext(), cfg.ClientId, cfg.ClientSecret, c.Query("code"), cfg.RedirectUrl)
+		if err == nil && !res.Ok {
+			err = fmt.Errorf("oauth.v2.access: %s", res.Error)
+		}
+		if err != nil {
+			h.Log.Error("Failed to install app", "error", err)
+			return c.Status(fiber.StatusBadGateway).SendString("Installation failed, please try again.")
+		}
+
+		err = h.Installations.SetInstallation(&store.Installation{
+			TeamId:      res.Team.Id,
+			TeamName:    res.Team.Name,
+			AppId:       res.AppId,
+			BotUserId:   res.BotUserId,
+			BotToken:    res.AccessToken,
+			Scope:       res.Scope,
+			InstalledAt: time.Now(),
+		})
+		if err != nil {
+			h.Log.Error("Failed to store installation", "error", err, "team_id", res.Team.Id)
+			return c.Status(fiber.StatusInternalServerError).SendString("Installation failed, please try again.")
+		}
+
+		h.Log.Info("Installed app", "team_id", res.Team.Id, "team_name", res.Team.Name)
+
+		return c.SendString(fmt.Sprintf("SlackGPT is now installed in %s, you can close this window.", res.Team.Name))
+	})
+}
+
+// withInstallation makes the Slack calls of an event use the bot token of the
+// workspace it came from. Teams without installation use the configured
+// SLACK_BOT_TOKEN.
+func (h *Handler) withInstallation(ctx context.Context, teamId string) (context.Context, error) {
+	if h.Installations == nil || teamId == "" {
+		return ctx, nil
+	}
+
+	installation, err := h.Installations.GetInstallation(teamId)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to get installation of team %s: %w", teamId, err)
+	}
+
+	if installation == nil {
+		h.Log.Debug("No installation, using default bot token", "team_id", teamId)
+		return ctx, nil
+	}
+
+	return slack.ContextWithToken(ctx, installation.BotToken), nil
+}
+
+// https://api.slack.com/events/app_uninstalled
+func (h *Handler) uninstall(teamId string) {
+	if h.Installations == nil {
+		return
+	}
+
+	if err := h.Installations.DeleteInstallation(teamId); err != nil {
+		h.Log.Error("Failed to delete installation", "error", err, "team_id", teamId)
+		return
+	}
+
+	h.Log.Info("Uninstalled app", "team_id", teamId)
+}
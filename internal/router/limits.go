@@ -0,0 +1,151 @@
+package router
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+)
+
+var (
+	RATE_LIMIT_MESSAGE = ":hourglass_flowing_sand: Sorry, I'm getting more messages than I can answer right now. Please try again in a minute."
+	BUDGET_MESSAGE     = ":money_with_wings: Sorry, today's budget is used up. Please try again tomorrow."
+)
+
+// exposed on /debug/vars
+var limitsHit = expvar.NewMap("limits_hit")
+
+// limited checks the rate limits, token and cost budgets of the event's user and
+// workspace and tells the user if one is hit. A failing counter store doesn't
+// silence the bot, the event is answered anyway.
+func (h *Handler) limited(ctx context.Context, event *Event) bool {
+	limit, message := h.checkLimits(event)
+	if limit == "" {
+		return false
+	}
+
+	limitsHit.Add(limit, 1)
+	h.Log.Info("Limit hit", "limit", limit, "team", event.Team, "user", event.User)
+
+	threadTs := event.ThreadTs
+	if threadTs == "" {
+		threadTs = event.Ts
+	}
+
+	h.Slack.AddToThread(ctx, message, event.Channel, threadTs)
+
+	return true
+}
+
+// checkLimits returns the name of the hit limit and the message for the user,
+// budgets are checked first as they don't count the message.
+func (h *Handler) checkLimits(event *Event) (limit, message string) {
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+
+	if h.overBudget("tokens/user/"+event.Team+"/"+event.User+"/"+day, h.Limits.UserDailyTokens) {
+		return "user_daily_tokens", BUDGET_MESSAGE
+	}
+
+	if h.overBudget("tokens/team/"+event.Team+"/"+day, h.Limits.TeamDailyTokens) {
+		return "team_daily_tokens", BUDGET_MESSAGE
+	}
+
+	if h.overBudget("cost/user/"+event.Team+"/"+event.User+"/"+day, microUsd(h.Limits.UserDailyUsd)) {
+		return "user_daily_usd", BUDGET_MESSAGE
+	}
+
+	if h.overBudget("cost/team/"+event.Team+"/"+day, microUsd(h.Limits.TeamDailyUsd)) {
+		return "team_daily_usd", BUDGET_MESSAGE
+	}
+
+	// fixed windows, a burst at the edge may get up to twice the limit
+	window := now.Truncate(h.Limits.Interval)
+	suffix := "/" + strconv.FormatInt(window.Unix(), 10)
+
+	if h.overRate("messages/user/"+event.Team+"/"+event.User+suffix, h.Limits.UserMessages, window.Add(h.Limits.Interval)) {
+		return "user_messages", RATE_LIMIT_MESSAGE
+	}
+
+	if h.overRate("messages/team/"+event.Team+suffix, h.Limits.TeamMessages, window.Add(h.Limits.Interval)) {
+		return "team_messages", RATE_LIMIT_MESSAGE
+	}
+
+	return "", ""
+}
+
+func (h *Handler) overBudget(key string, budget int) bool {
+	if budget <= 0 {
+		return false
+	}
+
+	used, err := h.Counters.GetCounter(key)
+	if err != nil {
+		h.Log.Error("Failed to get counter", "error", err, "key", key)
+		return false
+	}
+
+	return used >= budget
+}
+
+func (h *Handler) overRate(key string, limit int, expires time.Time) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	count, err := h.Counters.AddCounter(key, 1, expires)
+	if err != nil {
+		h.Log.Error("Failed to add counter", "error", err, "key", key)
+		return false
+	}
+
+	return count > limit
+}
+
+// chargeBudgets charges the tokens and cost of an answer to the budgets of the
+// event's user and workspace. The answer that exceeds a budget is still posted,
+// the next message is refused.
+func (h *Handler) chargeBudgets(event *Event, answer *openai.Answer) {
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+	tomorrow := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	tokens := answer.Usage.TotalTokens
+
+	if h.Limits.UserDailyTokens > 0 {
+		h.charge("tokens/user/"+event.Team+"/"+event.User+"/"+day, tokens, tomorrow)
+	}
+
+	if h.Limits.TeamDailyTokens > 0 {
+		h.charge("tokens/team/"+event.Team+"/"+day, tokens, tomorrow)
+	}
+
+	// counters are integers, so the cost is counted in millionths of a USD
+	price, ok := priceOf(h.Prices, answer.Model)
+	if !ok {
+		return
+	}
+
+	cost := int(math.Ceil(float64(answer.Usage.PromptTokens)*price.Input + float64(answer.Usage.CompletionTokens)*price.Output))
+
+	if h.Limits.UserDailyUsd > 0 {
+		h.charge("cost/user/"+event.Team+"/"+event.User+"/"+day, cost, tomorrow)
+	}
+
+	if h.Limits.TeamDailyUsd > 0 {
+		h.charge("cost/team/"+event.Team+"/"+day, cost, tomorrow)
+	}
+}
+
+func (h *Handler) charge(key string, amount int, expires time.Time) {
+	if _, err := h.Counters.AddCounter(key, amount, expires); err != nil {
+		h.Log.Error("Failed to add counter", "error", err, "key", key)
+	}
+}
+
+// microUsd converts a budget in USD to the unit of the cost counters
+func microUsd(usd float64) int {
+	return int(math.Round(usd * 1e6))
+}
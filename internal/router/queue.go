@@ -0,0 +1,45 @@
+package router
+
+import (
+	"sync"
+)
+
+// queue runs jobs with the same key strictly one after another while jobs of
+// different keys run in parallel. A worker goroutine lives only as long as
+// there are pending jobs for its key.
+type queue struct {
+	mu      sync.Mutex
+	pending map[string][]func()
+}
+
+func newQueue() *queue {
+	return &queue{pending: map[string][]func(){}}
+}
+
+func (q *queue) Push(key string, job func()) {
+	q.mu.Lock()
+	jobs, running := q.pending[key]
+	q.pending[key] = append(jobs, job)
+	q.mu.Unlock()
+
+	if !running {
+		go q.work(key)
+	}
+}
+
+func (q *queue) work(key string) {
+	for {
+		q.mu.Lock()
+		jobs := q.pending[key]
+		if len(jobs) == 0 {
+			delete(q.pending, key)
+			q.mu.Unlock()
+			return
+		}
+		job := jobs[0]
+		q.pending[key] = jobs[1:]
+		q.mu.Unlock()
+
+		job()
+	}
+}
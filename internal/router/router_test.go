@@ -0,0 +1,1424 @@
+package router_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/blockkit"
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/config"
+	"github.com/dominikwinter/slackgpt/internal/router"
+	"github.com/dominikwinter/slackgpt/internal/router/fake"
+	"github.com/dominikwinter/slackgpt/internal/store"
+	"github.com/dominikwinter/slackgpt/internal/testserver"
+	"github.com/gofiber/fiber/v3"
+)
+
+type I = map[string]interface{}
+
+const signingSecret = "test-signing-secret"
+
+type env struct {
+	cfg     *config.Config
+	slack   *testserver.Slack
+	openai  *testserver.OpenAI
+	handler *router.Handler
+	app     *fiber.App
+}
+
+func setup(t *testing.T, configure ...func(cfg *config.Config)) *env {
+	t.Helper()
+
+	e := &env{
+		slack:  testserver.NewSlack(),
+		openai: testserver.NewOpenAI(),
+		app:    fiber.New(),
+	}
+	t.Cleanup(e.slack.Close)
+	t.Cleanup(e.openai.Close)
+
+	e.cfg = config.Default()
+	e.cfg.Slack.ApiUrl = e.slack.URL
+	e.cfg.Slack.BotToken = "xoxb-test"
+	e.cfg.Slack.SigningSecret = signingSecret
+	e.cfg.Slack.StreamingInterval = time.Millisecond
+	e.cfg.OpenAI.ApiUrl = e.openai.URL
+	e.cfg.OpenAI.ApiKey = "sk-test"
+	e.cfg.OpenAI.Organization = "org-test"
+	e.cfg.OpenAI.AssistantId = "asst_test"
+	e.cfg.OpenAI.RunPollInterval = time.Millisecond
+	e.cfg.OpenAI.RunMaxPollInterval = 5 * time.Millisecond
+
+	for _, fn := range configure {
+		fn(e.cfg)
+	}
+
+	if err := e.cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := router.New(e.cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.handler = handler
+	e.handler.Setup(context.Background(), e.app, signingSecret)
+
+	return e
+}
+
+// send posts a signed request to the events endpoint
+func (e *env) send(t *testing.T, body I, headers ...string) *http.Response {
+	t.Helper()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte("v0:" + ts + ":" + string(b)))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/events", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := e.app.Test(req, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+// drain waits for all dispatched events to be processed
+func (e *env) drain(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := e.handler.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// posts returns the text of all chat.postMessage and chat.update calls
+func (e *env) posts() []string {
+	var texts []string
+
+	for _, call := range e.slack.Calls("chat.postMessage", "chat.update") {
+		texts = append(texts, call.Params["text"].(string))
+	}
+
+	return texts
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func message(eventId, ts, threadTs, text string) I {
+	event := I{
+		"type":         "message",
+		"channel":      "D0CHANNEL",
+		"channel_type": "im",
+		"user":         "U0USER",
+		"text":         text,
+		"ts":           ts,
+		"event_ts":     ts,
+		"user_profile": I{"real_name": "Jane Doe"},
+	}
+
+	if threadTs != "" {
+		event["thread_ts"] = threadTs
+	}
+
+	return I{
+		"type":     "event_callback",
+		"team_id":  "T0TEAM",
+		"event_id": eventId,
+		"event":    event,
+	}
+}
+
+func TestUrlVerification(t *testing.T) {
+	e := setup(t)
+
+	res := e.send(t, I{"type": "url_verification", "challenge": "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"})
+	body, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK || string(body) != "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+}
+
+func TestInvalidSignature(t *testing.T) {
+	e := setup(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(`{"type":"url_verification","challenge":"x"}`))
+	req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set("X-Slack-Signature", "v0=invalid")
+
+	res, err := e.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", res.StatusCode)
+	}
+}
+
+func TestUnsignedEventIsNotProcessed(t *testing.T) {
+	e := setup(t)
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	for name, headers := range map[string][]string{
+		"wrong signature":   {"X-Slack-Signature", "v0=invalid"},
+		"missing signature": {"X-Slack-Signature", ""},
+		"stale timestamp":   {"X-Slack-Request-Timestamp", stale},
+		"missing timestamp": {"X-Slack-Request-Timestamp", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, _ := json.Marshal(message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/events", bytes.NewReader(b))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Slack-Request-Timestamp", now)
+			req.Header.Set("X-Slack-Signature", "v0=invalid")
+			req.Header.Set(headers[0], headers[1])
+
+			res, err := e.app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404, got %d", res.StatusCode)
+			}
+		})
+	}
+
+	e.drain(t)
+
+	if calls := e.slack.Calls(); len(calls) != 0 || e.openai.Threads() != 0 {
+		t.Fatalf("expected unsigned events to be dropped, got %v", calls)
+	}
+}
+
+// dispatch passes the body to the handler directly, without the HTTP endpoint
+func dispatch(t *testing.T, handler *router.Handler, body I) {
+	t.Helper()
+
+	b, _ := json.Marshal(body)
+
+	var req router.SlackRequestBody
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	if !handler.Dispatch(context.Background(), &req, "", "") {
+		t.Fatal("expected the event to be accepted")
+	}
+}
+
+func TestRestartKeepsThreadsInStoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	e := setup(t, chatBackend, func(cfg *config.Config) {
+		cfg.Threads.StorePath = filepath.Join(dir, "threads.db")
+		cfg.Events.StorePath = filepath.Join(dir, "events.db")
+		cfg.Replies.StorePath = filepath.Join(dir, "replies.db")
+		cfg.Limits.StorePath = filepath.Join(dir, "limits.db")
+		cfg.Usage.StorePath = filepath.Join(dir, "usage.db")
+		cfg.History.StorePath = filepath.Join(dir, "history.db")
+	})
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	if err := e.handler.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files are locked until closed
+	restarted, err := router.New(e.cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	if threadId, err := restarted.Threads.GetThread("D0CHANNEL", "1700000000.000100"); err != nil || threadId == "" {
+		t.Fatalf("expected the thread to survive the restart, got %q %v", threadId, err)
+	}
+}
+
+func TestConversationWithFakes(t *testing.T) {
+	cfg := config.Default()
+	slackApi := &fake.Slack{}
+	assistant := &fake.Assistant{}
+
+	handler := router.NewHandler(cfg, slackApi, assistant, store.NewMemoryThreadStore(), store.NewMemoryEventStore(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	dispatch(t, handler, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	dispatch(t, handler, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := slackApi.Posts()
+	if len(posts) != 2 || posts[0].AiThreadId != "thread_1" || posts[1].Text != "echo: We worked on a project" {
+		t.Fatalf("unexpected posts %+v", posts)
+	}
+
+	messages := assistant.Messages()
+	if len(messages) != 2 || messages[1].ThreadId != "thread_1" {
+		t.Fatalf("expected both messages in the same thread, got %+v", messages)
+	}
+}
+
+func TestDirectMessageStartsThread(t *testing.T) {
+	e := setup(t)
+
+	res := e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	e.drain(t)
+
+	calls := e.slack.Calls("chat.postMessage")
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 message, got %v", e.posts())
+	}
+
+	params := calls[0].Params
+	if params["thread_ts"] != "1700000000.000100" || params["text"] != blockkit.Text("echo: "+strings.TrimSpace(e.openai.Messages("thread_1")[0][len("user: "):])) {
+		t.Fatalf("unexpected message %v", params)
+	}
+
+	// the last block holds the OpenAI thread id for threads unknown to the store
+	blocks := params["blocks"].([]interface{})
+	context := blocks[len(blocks)-1].(I)["elements"].([]interface{})[0].(I)
+	if context["text"] != "1" {
+		t.Fatalf("expected thread id in context block, got %v", context)
+	}
+
+	if !strings.Contains(e.openai.Messages("thread_1")[0], "Feedback for <@U0COLLEAGUE>") {
+		t.Fatalf("prompt misses user text: %v", e.openai.Messages("thread_1"))
+	}
+
+	reactions := e.slack.Calls("reactions.add", "reactions.remove")
+	if len(reactions) != 2 || reactions[0].Method != "reactions.add" || reactions[1].Method != "reactions.remove" {
+		t.Fatalf("expected thinking reaction to be added and removed, got %v", reactions)
+	}
+
+	for _, call := range e.slack.Calls() {
+		if call.Token != "xoxb-test" {
+			t.Fatalf("unexpected token %q for %s", call.Token, call.Method)
+		}
+	}
+
+	for _, request := range e.openai.Requests() {
+		if request.Header.Get("OpenAI-Beta") != "assistants=v2" || request.Header.Get("Authorization") != "Bearer sk-test" {
+			t.Fatalf("unexpected headers %v for %s", request.Header, request.Path)
+		}
+	}
+}
+
+func TestAnswerIsRenderedAsBlocks(t *testing.T) {
+	e := setup(t)
+	e.openai.Answer = func(threadId, content string) string {
+		return "# Feedback for **John**\n\nHe is *great* at [Go](https://go.dev).\n\n" +
+			"1. first\n2. second\n   - nested\n\n" +
+			"```go\nfmt.Println(\"hi\")\n```\n\n---\n\n" +
+			strings.Repeat("A long sentence about the project. ", 150)
+	}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	calls := e.slack.Calls("chat.postMessage")
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 message, got %v", e.posts())
+	}
+
+	var types []string
+	for _, block := range calls[0].Params["blocks"].([]interface{}) {
+		block := block.(I)
+		types = append(types, block["type"].(string))
+
+		if block["type"] == "section" && len(block["text"].(I)["text"].(string)) > 3000 {
+			t.Fatalf("section exceeds 3000 characters: %d", len(block["text"].(I)["text"].(string)))
+		}
+	}
+
+	expected := "header section rich_text rich_text divider section section context"
+	if strings.Join(types, " ") != expected {
+		t.Fatalf("expected blocks %s, got %v", expected, types)
+	}
+
+	blocks := calls[0].Params["blocks"].([]interface{})
+	header := blocks[0].(I)["text"].(I)["text"]
+	section := blocks[1].(I)["text"].(I)["text"]
+	list := blocks[2].(I)["elements"].([]interface{})
+
+	if header != "Feedback for John" || section != "He is _great_ at <https://go.dev|Go>." || len(list) != 2 {
+		t.Fatalf("unexpected blocks %v", blocks[:3])
+	}
+}
+
+func TestReplyContinuesThread(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 1 })
+
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.drain(t)
+
+	if e.openai.Threads() != 1 {
+		t.Fatalf("expected 1 OpenAI thread, got %d", e.openai.Threads())
+	}
+
+	posts := e.posts()
+	if len(posts) != 2 || posts[1] != "echo: We worked on a project" {
+		t.Fatalf("unexpected posts %v", posts)
+	}
+}
+
+func TestEventsOfAThreadAreProcessedInOrder(t *testing.T) {
+	e := setup(t)
+	// slow runs, so later events arrive while earlier ones are processed
+	e.openai.RunStatuses = []string{"queued", "in_progress", "in_progress", "in_progress", "in_progress", "completed"}
+
+	threads := map[string]string{"A": "1700000000.000100", "B": "1700000000.000200"}
+
+	// A1, B1, A2, B2, A3, B3 where 2 and 3 are replies in the thread of 1
+	for i := 1; i <= 3; i++ {
+		for _, thread := range []string{"A", "B"} {
+			ts, threadTs := threads[thread], ""
+			if i > 1 {
+				// e.g. 1700000000.000102
+				ts, threadTs = fmt.Sprintf("%s%02d", threads[thread][:15], i), threads[thread]
+			}
+
+			e.send(t, message("Ev"+thread+strconv.Itoa(i), ts, threadTs, thread+strconv.Itoa(i)))
+		}
+	}
+	e.drain(t)
+
+	threadIds := e.openai.ThreadIds()
+	if len(threadIds) != 2 {
+		t.Fatalf("expected 2 OpenAI threads, got %v", threadIds)
+	}
+
+	for _, threadId := range threadIds {
+		var questions []string
+		for _, m := range e.openai.Messages(threadId) {
+			if strings.HasPrefix(m, "user: ") {
+				questions = append(questions, m)
+			}
+		}
+
+		if len(questions) != 3 {
+			t.Fatalf("expected 3 questions in %s, got %v", threadId, questions)
+		}
+
+		// the first question is wrapped in the prompt
+		thread := "A"
+		if strings.Contains(questions[0], "Text: B1") {
+			thread = "B"
+		}
+
+		for i, question := range questions {
+			if want := thread + strconv.Itoa(i+1); !strings.Contains(question, want) {
+				t.Fatalf("expected %s as question %d of thread %s, got %v", want, i+1, thread, questions)
+			}
+		}
+	}
+}
+
+func TestReplyRecoversThreadFromHistory(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	// new handler with an empty in-memory store, like after a restart
+	restarted, err := router.New(e.cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.slack.AddMessage("D0CHANNEL", I{"ts": "1700000000.000100", "text": "Feedback for <@U0COLLEAGUE>", "user": "U0USER"})
+
+	e.app = fiber.New()
+	e.handler = restarted
+	e.handler.Setup(context.Background(), e.app, signingSecret)
+
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.drain(t)
+
+	if e.openai.Threads() != 1 {
+		t.Fatalf("expected 1 OpenAI thread, got %d", e.openai.Threads())
+	}
+
+	messages := e.openai.Messages("thread_1")
+	if len(messages) != 4 || messages[2] != "user: We worked on a project" {
+		t.Fatalf("unexpected thread messages %v", messages)
+	}
+}
+
+func TestDuplicateEventIsDropped(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	res := e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"),
+		"X-Slack-Retry-Num", "1",
+		"X-Slack-Retry-Reason", "http_timeout",
+	)
+	e.drain(t)
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected retry to be acknowledged, got %d", res.StatusCode)
+	}
+
+	if len(e.slack.Calls("chat.postMessage")) != 1 || e.openai.Threads() != 1 {
+		t.Fatalf("expected a single answer, got %v", e.posts())
+	}
+}
+
+// mention is a message in a public channel, delivered as message and, if it
+// mentions the bot, as app_mention
+func mention(eventType, eventId, ts, threadTs, text string) I {
+	body := message(eventId, ts, threadTs, text)
+	body["authorizations"] = []I{{"team_id": "T0TEAM", "user_id": "U0BOT", "is_bot": true}}
+
+	event := body["event"].(I)
+	event["type"] = eventType
+	event["channel"] = "C0CHANNEL"
+
+	if eventType == "app_mention" {
+		delete(event, "channel_type")
+		delete(event, "user_profile")
+	} else {
+		event["channel_type"] = "channel"
+	}
+
+	return body
+}
+
+func TestChannelMessageWithoutMentionIsIgnored(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, mention("message", "Ev1", "1700000000.000100", "", "Lunch anyone?"))
+	e.drain(t)
+
+	if len(e.slack.Calls()) != 0 || e.openai.Threads() != 0 {
+		t.Fatalf("expected channel chatter to be ignored, got %v", e.slack.Calls())
+	}
+}
+
+func TestAppMentionStartsThreadInChannel(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, mention("message", "Ev1", "1700000000.000100", "", "<@U0BOT> Feedback for <@U0COLLEAGUE>"))
+	e.send(t, mention("app_mention", "Ev2", "1700000000.000100", "", "<@U0BOT> Feedback for <@U0COLLEAGUE>"))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 1 })
+
+	// replies in the bot's thread need no mention
+	e.send(t, mention("message", "Ev3", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.drain(t)
+
+	if e.openai.Threads() != 1 {
+		t.Fatalf("expected mention to be answered once, got %d threads", e.openai.Threads())
+	}
+
+	messages := e.openai.Messages("thread_1")
+	if strings.Contains(messages[0], "U0BOT") || !strings.Contains(messages[0], "Text: Feedback for <@U0COLLEAGUE>") {
+		t.Fatalf("expected bot mention to be stripped, got %q", messages[0])
+	}
+
+	calls := e.slack.Calls("chat.postMessage")
+	if len(calls) != 2 || calls[0].Params["channel"] != "C0CHANNEL" || calls[1].Params["text"] != "echo: We worked on a project" {
+		t.Fatalf("unexpected posts %v", e.posts())
+	}
+}
+
+func TestChannelTypeModeOff(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Slack.ChannelTypes.Channel = router.ModeOff
+	})
+
+	e.send(t, mention("app_mention", "Ev1", "1700000000.000100", "", "<@U0BOT> Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	if len(e.slack.Calls()) != 0 {
+		t.Fatalf("expected mention to be ignored, got %v", e.slack.Calls())
+	}
+}
+
+// edited is a message_changed event, the event itself is sent by Slack and
+// not by the user
+func edited(eventId, ts, threadTs, previous, text string) I {
+	body := message(eventId, "1700000000.009000", "", "")
+
+	event := body["event"].(I)
+	delete(event, "user")
+	event["subtype"] = "message_changed"
+	event["message"] = message("", ts, threadTs, text)["event"]
+	event["previous_message"] = message("", ts, threadTs, previous)["event"]
+
+	return body
+}
+
+// botMessages returns the texts of the bot's messages in the channel
+func (e *env) botMessages(channel string) []string {
+	var texts []string
+
+	for _, message := range e.slack.Messages(channel) {
+		if message["bot_id"] != nil {
+			texts = append(texts, message["text"].(string))
+		}
+	}
+
+	return texts
+}
+
+func TestEditedQuestionIsAnsweredAgain(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 2 })
+
+	e.send(t, edited("Ev3", "1700000000.000200", "1700000000.000100", "We worked on a project", "We worked on two projects"))
+	e.drain(t)
+
+	texts := e.botMessages("D0CHANNEL")
+	if len(texts) != 2 || texts[1] != "echo: "+fmt.Sprintf(router.EDIT_PROMPT, "We worked on two projects") {
+		t.Fatalf("expected answer to be replaced, got %v", texts)
+	}
+}
+
+func TestEditedOlderQuestionIsIgnored(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 2 })
+
+	e.send(t, edited("Ev3", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>", "Feedback for <@U0OTHER>"))
+	e.drain(t)
+
+	if len(e.slack.Calls("chat.update")) != 0 || len(e.openai.Messages("thread_1")) != 4 {
+		t.Fatalf("expected edit to be ignored, got %v", e.posts())
+	}
+}
+
+func TestDeletedQuestionDeletesAnswer(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 2 })
+
+	body := message("Ev3", "1700000000.009000", "", "")
+	event := body["event"].(I)
+	delete(event, "user")
+	event["subtype"] = "message_deleted"
+	event["deleted_ts"] = "1700000000.000200"
+	event["previous_message"] = message("", "1700000000.000200", "1700000000.000100", "We worked on a project")["event"]
+
+	e.send(t, body)
+	e.drain(t)
+
+	texts := e.botMessages("D0CHANNEL")
+	if len(texts) != 1 || texts[0] == "echo: We worked on a project" {
+		t.Fatalf("expected answer to be deleted, got %v", texts)
+	}
+}
+
+func fileShare(eventId, ts string, files ...I) I {
+	body := message(eventId, ts, "", "Feedback for <@U0COLLEAGUE>, see the retro")
+
+	event := body["event"].(I)
+	event["subtype"] = "file_share"
+	event["files"] = files
+
+	return body
+}
+
+func TestSharedFilesAreForwarded(t *testing.T) {
+	e := setup(t)
+	e.slack.Files["retro.pdf"] = []byte("%PDF-1.7 retro")
+
+	e.send(t, fileShare("Ev1", "1700000000.000100", I{
+		"id":          "F0FILE",
+		"name":        "retro.pdf",
+		"mimetype":    "application/pdf",
+		"size":        14,
+		"url_private": e.slack.FileUrl("retro.pdf"),
+	}))
+	e.drain(t)
+
+	if messages := e.openai.Messages("thread_1"); len(messages) == 0 || !strings.Contains(messages[0], "retro.pdf (application/pdf, 14 bytes)") {
+		t.Fatalf("expected file to be mentioned, got %v", messages)
+	}
+
+	files := e.openai.Files()
+	if len(files) != 1 || files[0].Filename != "retro.pdf" || files[0].Purpose != "assistants" || string(files[0].Content) != "%PDF-1.7 retro" {
+		t.Fatalf("expected file to be uploaded, got %v", files)
+	}
+
+	if attachments := e.openai.Attachments("thread_1"); len(attachments) != 1 || attachments[0] != files[0].Id {
+		t.Fatalf("expected file to be attached, got %v", attachments)
+	}
+
+	if downloads := e.slack.Calls("files"); len(downloads) != 1 || downloads[0].Token != "xoxb-test" {
+		t.Fatalf("expected download with bot token, got %v", downloads)
+	}
+}
+
+func TestSharedImagesAreShownToTheModel(t *testing.T) {
+	e := setup(t)
+	e.slack.Files["screenshot.png"] = []byte("\x89PNG")
+
+	e.send(t, fileShare("Ev1", "1700000000.000100", I{
+		"id":          "F0IMAGE",
+		"name":        "screenshot.png",
+		"mimetype":    "image/png",
+		"size":        4,
+		"url_private": e.slack.FileUrl("screenshot.png"),
+	}))
+	e.drain(t)
+
+	files := e.openai.Files()
+	if len(files) != 1 || files[0].Purpose != "vision" {
+		t.Fatalf("expected image to be uploaded for vision, got %v", files)
+	}
+
+	if images := e.openai.Images("thread_1"); len(images) != 1 || images[0] != files[0].Id {
+		t.Fatalf("expected image content part, got %v", images)
+	}
+
+	if attachments := e.openai.Attachments("thread_1"); len(attachments) != 0 {
+		t.Fatalf("expected no file_search attachment, got %v", attachments)
+	}
+}
+
+func TestSharedFilesOutsideLimitsAreSkipped(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Files.MaxSizeMb = 1
+	})
+	e.slack.Files["huge.pdf"] = []byte("%PDF-1.7")
+	e.slack.Files["photo.heic"] = []byte("heic")
+
+	e.send(t, fileShare("Ev1", "1700000000.000100",
+		I{"id": "F0HUGE", "name": "huge.pdf", "mimetype": "application/pdf", "size": 2 << 20, "url_private": e.slack.FileUrl("huge.pdf")},
+		I{"id": "F0HEIC", "name": "photo.heic", "mimetype": "image/heic", "size": 4, "url_private": e.slack.FileUrl("photo.heic")},
+	))
+	e.drain(t)
+
+	if len(e.openai.Files()) != 0 || len(e.slack.Calls("files")) != 0 {
+		t.Fatalf("expected files to be skipped, got %v", e.openai.Files())
+	}
+
+	posts := e.posts()
+	if len(posts) != 2 || !strings.Contains(posts[0], "huge.pdf, photo.heic") || !strings.Contains(posts[0], "up to 1 MB") {
+		t.Fatalf("expected skipped files to be reported, got %v", posts)
+	}
+}
+
+func TestSharedFilesLargerThanAnnouncedAreSkipped(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Files.MaxSizeMb = 1
+	})
+	// within FILE_MAX_SIZE_MB, but not what Slack announced
+	e.slack.Files["huge.pdf"] = bytes.Repeat([]byte("x"), 900<<10)
+
+	e.send(t, fileShare("Ev1", "1700000000.000100",
+		I{"id": "F0HUGE", "name": "huge.pdf", "mimetype": "application/pdf", "size": 14, "url_private": e.slack.FileUrl("huge.pdf")},
+	))
+	e.drain(t)
+
+	if len(e.openai.Files()) != 0 || len(e.openai.Attachments("thread_1")) != 0 {
+		t.Fatalf("expected the file not to be uploaded, got %v", e.openai.Files())
+	}
+
+	posts := e.posts()
+	if len(posts) != 2 || !strings.Contains(posts[0], "I can't read huge.pdf") {
+		t.Fatalf("expected the skipped file to be reported, got %v", posts)
+	}
+}
+
+func TestFailedRunPostsErrorMessage(t *testing.T) {
+	e := setup(t)
+	e.openai.RunStatuses = []string{"queued", "failed"}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) != 1 || posts[0] != router.DEFAULT_ERROR_MESSAGE {
+		t.Fatalf("expected error message, got %v", posts)
+	}
+}
+
+func TestRateLimitRefusesMessages(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Limits.UserMessages = 1
+		cfg.Limits.Interval = time.Hour
+	})
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) != 2 || posts[1] != router.RATE_LIMIT_MESSAGE || len(e.openai.Messages("thread_1")) != 2 {
+		t.Fatalf("expected second message to be refused, got %v", posts)
+	}
+}
+
+func TestTokenBudgetRefusesMessages(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Limits.TeamDailyTokens = 20
+	})
+	e.openai.Usage = openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.send(t, message("Ev3", "1700000000.000300", "1700000000.000100", "It went well"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) != 3 || posts[1] != "echo: We worked on a project" || posts[2] != router.BUDGET_MESSAGE {
+		t.Fatalf("expected third message to be refused, got %v", posts)
+	}
+}
+
+func TestCostBudgetRefusesMessages(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Limits.UserDailyUsd = 0.0002
+	})
+	// gpt-4o: 10 * 5 + 5 * 15 USD per million tokens, 0.000125 USD per answer
+	e.openai.Usage = openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.send(t, message("Ev3", "1700000000.000300", "1700000000.000100", "It went well"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) != 3 || posts[1] != "echo: We worked on a project" || posts[2] != router.BUDGET_MESSAGE {
+		t.Fatalf("expected third message to be refused, got %v", posts)
+	}
+}
+
+func (e *env) usage(t *testing.T, query, apiKey string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/usage?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	res, err := e.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(res.Body)
+
+	return res.StatusCode, string(body)
+}
+
+func TestUsageIsReportedPerTeam(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Usage.ApiKeys = []string{"report-key"}
+	})
+	e.handler.SetupUsage(e.app, e.cfg.Usage)
+	e.openai.Usage = openai.Usage{PromptTokens: 1000000, CompletionTokens: 100000, TotalTokens: 1100000}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.drain(t)
+
+	if status, _ := e.usage(t, "", "wrong-key"); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", status)
+	}
+
+	status, body := e.usage(t, "by=model", "report-key")
+
+	var report struct{ Rows []router.UsageRow }
+	if err := json.Unmarshal([]byte(body), &report); status != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+
+	// gpt-4o costs 5 USD per million prompt and 15 per million completion tokens
+	month := time.Now().UTC().Format("2006-01")
+	want := router.UsageRow{Month: month, TeamId: "T0TEAM", Model: "gpt-4o", Runs: 2, PromptTokens: 2000000, CompletionTokens: 200000, TotalTokens: 2200000, CostUsd: 13}
+	if len(report.Rows) != 1 || report.Rows[0] != want {
+		t.Fatalf("unexpected report %+v", report.Rows)
+	}
+
+	_, body = e.usage(t, "format=csv&by=user", "report-key")
+	if !strings.Contains(body, month+",T0TEAM,U0USER,,,2,2000000,200000,2200000,13.000000") {
+		t.Fatalf("unexpected csv %q", body)
+	}
+}
+
+func TestAnswersWithoutTokensAreReported(t *testing.T) {
+	e := setup(t, chatBackend, func(cfg *config.Config) {
+		cfg.OpenAI.Backend = "local"
+		cfg.Usage.ApiKeys = []string{"report-key"}
+	})
+	e.handler.SetupUsage(e.app, e.cfg.Usage)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	_, body := e.usage(t, "format=csv", "report-key")
+	if !strings.Contains(body, ",T0TEAM,,,,1,0,0,0,0.000000") {
+		t.Fatalf("expected the run to be counted, got %q", body)
+	}
+}
+
+func TestDebugVarsRequireApiKey(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Usage.ApiKeys = []string{"report-key"}
+	})
+	e.handler.SetupUsage(e.app, e.cfg.Usage)
+
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "wrong-key": http.StatusUnauthorized, "report-key": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		res, err := e.app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != want {
+			t.Fatalf("expected %d with key %q, got %d", want, key, res.StatusCode)
+		}
+	}
+}
+
+func TestRunRequiringActionCallsTools(t *testing.T) {
+	e := setup(t)
+	e.slack.Users["U0COLLEAGUE"] = &slack.User{
+		Id:      "U0COLLEAGUE",
+		Tz:      "Europe/Berlin",
+		Profile: slack.UserProfile{RealName: "John Smith", Title: "Engineer"},
+	}
+
+	call := openai.ToolCall{Id: "call_1", Type: "function"}
+	call.Function.Name = "get_slack_user"
+	call.Function.Arguments = `{"user_id":"U0COLLEAGUE"}`
+
+	e.openai.RunStatuses = []string{"queued", "requires_action", "in_progress", "completed"}
+	e.openai.ToolCalls = []openai.ToolCall{call}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	outputs := e.openai.ToolOutputs()
+	if len(outputs) != 1 || outputs[0].ToolCallId != "call_1" || !strings.Contains(outputs[0].Output, `"real_name":"John Smith"`) {
+		t.Fatalf("unexpected tool outputs %v", outputs)
+	}
+
+	if len(e.slack.Calls("chat.postMessage")) != 1 {
+		t.Fatalf("expected answer after tool call, got %v", e.posts())
+	}
+}
+
+func TestStreamingUpdatesPlaceholder(t *testing.T) {
+	e := setup(t, func(cfg *config.Config) {
+		cfg.Slack.Streaming = true
+	})
+	e.openai.Answer = func(threadId, content string) string {
+		return "Who is the colleague you want to give feedback to?"
+	}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Hi"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) < 2 || posts[0] != router.STREAMING_PLACEHOLDER || posts[len(posts)-1] != "Who is the colleague you want to give feedback to?" {
+		t.Fatalf("unexpected posts %v", posts)
+	}
+
+	updates := e.slack.Calls("chat.update")
+	if updates[len(updates)-1].Params["blocks"] == nil {
+		t.Fatal("expected final update to contain the thread blocks")
+	}
+}
+
+func chatBackend(cfg *config.Config) {
+	cfg.OpenAI.Backend = "chat"
+	cfg.OpenAI.AssistantId = ""
+	cfg.OpenAI.Instructions = "You are a feedback assistant."
+}
+
+func TestChatBackendSendsHistory(t *testing.T) {
+	e := setup(t, chatBackend)
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.send(t, message("Ev2", "1700000000.000200", "1700000000.000100", "We worked on a project"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) != 2 || posts[1] != "echo: We worked on a project" {
+		t.Fatalf("unexpected posts %v", posts)
+	}
+
+	chats := e.openai.Chats()
+	if len(chats) != 2 || len(chats[1]) != 4 ||
+		chats[1][0] != "system: You are a feedback assistant." ||
+		!strings.HasPrefix(chats[1][2], "assistant: echo: Parse the") ||
+		chats[1][3] != "user: We worked on a project" {
+		t.Fatalf("expected history to be sent, got %q", chats)
+	}
+
+	if e.openai.Threads() != 0 {
+		t.Fatalf("expected no assistants threads, got %d", e.openai.Threads())
+	}
+}
+
+func TestChatBackendStreamsAndCallsTools(t *testing.T) {
+	e := setup(t, chatBackend, func(cfg *config.Config) {
+		cfg.Slack.Streaming = true
+	})
+	e.slack.Users["U0COLLEAGUE"] = &slack.User{Id: "U0COLLEAGUE", Profile: slack.UserProfile{RealName: "John Smith"}}
+
+	call := openai.ToolCall{Id: "call_1", Type: "function"}
+	call.Function.Name = "get_slack_user"
+	call.Function.Arguments = `{"user_id":"U0COLLEAGUE"}`
+	e.openai.ToolCalls = []openai.ToolCall{call}
+	e.openai.Answer = func(threadId, content string) string {
+		return "Which competence does John work in?"
+	}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	posts := e.posts()
+	if len(posts) < 2 || posts[0] != router.STREAMING_PLACEHOLDER || posts[len(posts)-1] != "Which competence does John work in?" {
+		t.Fatalf("unexpected posts %v", posts)
+	}
+
+	outputs := e.openai.ToolOutputs()
+	if len(outputs) != 1 || outputs[0].ToolCallId != "call_1" || !strings.Contains(outputs[0].Output, `"real_name":"John Smith"`) {
+		t.Fatalf("unexpected tool outputs %v", outputs)
+	}
+}
+
+func TestChatBackendReadsHistoryFromSlack(t *testing.T) {
+	e := setup(t, chatBackend, func(cfg *config.Config) {
+		cfg.History.Source = "slack"
+		cfg.History.MaxTokens = 100
+	})
+	e.slack.Users["U0COLLEAGUE"] = &slack.User{Id: "U0COLLEAGUE", RealName: "John Smith"}
+	e.slack.Users["U0OTHER"] = &slack.User{Id: "U0OTHER", RealName: "Max Mustermann"}
+
+	root := e.slack.AddMessage("D0CHANNEL", I{"type": "message", "user": "U0USER", "text": "Feedback for <@U0COLLEAGUE>"})
+	e.send(t, message("Ev1", root, "", "Feedback for <@U0COLLEAGUE>"))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 1 })
+
+	// more than a page of replies, only the latest fit into the token budget
+	for i := 0; i < 250; i++ {
+		e.slack.AddMessage("D0CHANNEL", I{"type": "message", "user": "U0OTHER", "thread_ts": root, "text": fmt.Sprintf("Note %d about <@U0COLLEAGUE>", i)})
+	}
+
+	reply := e.slack.AddMessage("D0CHANNEL", I{"type": "message", "user": "U0USER", "thread_ts": root, "text": "We worked on a project"})
+	e.send(t, message("Ev2", reply, root, "We worked on a project"))
+	e.drain(t)
+
+	chats := e.openai.Chats()
+	if len(chats) != 2 || len(chats[0]) != 2 || !strings.HasPrefix(chats[0][1], "user: \n\t\tParse the") {
+		t.Fatalf("expected the first message without history, got %q", chats)
+	}
+
+	last := chats[1]
+	if len(last) < 4 || len(last) > 20 ||
+		last[0] != "system: You are a feedback assistant." ||
+		last[1] == "user: @Max Mustermann: Note 0 about @John Smith" ||
+		last[len(last)-2] != "user: @Max Mustermann: Note 249 about @John Smith" ||
+		last[len(last)-1] != "user: We worked on a project" {
+		t.Fatalf("expected the latest replies of the thread, got %q", last)
+	}
+
+	pages := 0
+	for _, call := range e.slack.Calls("conversations.replies") {
+		if call.Params["cursor"] != nil {
+			pages++
+		}
+	}
+
+	if pages != 1 {
+		t.Fatalf("expected the thread to be read in two pages, got %v", e.slack.Calls("conversations.replies"))
+	}
+}
+
+func TestSlackHistoryKeepsOtherBotsAndSkipsNotes(t *testing.T) {
+	e := setup(t, chatBackend, func(cfg *config.Config) {
+		cfg.History.Source = "slack"
+	})
+	e.slack.Users["U0USER"] = &slack.User{Id: "U0USER", RealName: "Jane Doe"}
+	e.slack.Users["U0REMINDER"] = &slack.User{Id: "U0REMINDER", RealName: "Reminder"}
+
+	withBot := func(body I) I {
+		body["authorizations"] = []I{{"team_id": "T0TEAM", "user_id": "U0BOT", "is_bot": true}}
+		return body
+	}
+
+	root := e.slack.AddMessage("D0CHANNEL", I{"type": "message", "user": "U0USER", "text": "Feedback for Max"})
+	e.send(t, withBot(message("Ev1", root, "", "Feedback for Max")))
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 1 })
+
+	e.slack.AddMessage("D0CHANNEL", I{"type": "message", "bot_id": "B0REMINDER", "user": "U0REMINDER", "thread_ts": root, "text": "Max is on vacation"})
+	e.slack.AddMessage("D0CHANNEL", I{"type": "message", "bot_id": "B0BOT", "user": "U0BOT", "thread_ts": root, "text": blockkit.Text(router.BUDGET_MESSAGE)})
+
+	reply := e.slack.AddMessage("D0CHANNEL", I{"type": "message", "user": "U0USER", "thread_ts": root, "text": "We worked on a project"})
+	e.send(t, withBot(message("Ev2", reply, root, "We worked on a project")))
+	e.drain(t)
+
+	chats := e.openai.Chats()
+	if len(chats) != 2 {
+		t.Fatalf("expected 2 chats, got %q", chats)
+	}
+
+	last := chats[1]
+	if len(last) != 5 ||
+		last[1] != "user: @Jane Doe: Feedback for Max" ||
+		!strings.HasPrefix(last[2], "assistant: echo: ") ||
+		last[3] != "user: @Reminder: Max is on vacation" ||
+		last[4] != "user: We worked on a project" {
+		t.Fatalf("expected the other bot as user and no budget note, got %q", last)
+	}
+}
+
+func TestLocalBackendSendsNoCredentials(t *testing.T) {
+	e := setup(t, chatBackend, func(cfg *config.Config) {
+		cfg.OpenAI.Backend = "local"
+		cfg.OpenAI.Model = "llama3"
+		cfg.OpenAI.ApiKey = ""
+		cfg.OpenAI.Organization = ""
+		cfg.OpenAI.Tools = false
+	})
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	if posts := e.posts(); len(posts) != 1 || !strings.HasPrefix(posts[0], "echo: ") {
+		t.Fatalf("unexpected posts %v", posts)
+	}
+
+	requests := e.openai.Requests()
+	if len(requests) != 1 || requests[0].Path != "/v1/chat/completions" {
+		t.Fatalf("expected a single chat completion, got %v", requests)
+	}
+
+	for _, header := range []string{"Authorization", "OpenAI-Organization", "OpenAI-Beta"} {
+		if value := requests[0].Header.Get(header); value != "" {
+			t.Fatalf("unexpected %s header %q", header, value)
+		}
+	}
+}
+
+func TestAzureUsesDeploymentsAndApiKey(t *testing.T) {
+	azure := func(cfg *config.Config) {
+		cfg.OpenAI.ApiType = "azure"
+		cfg.OpenAI.ApiVersion = "2024-05-01-preview"
+		cfg.OpenAI.Model = "feedback-gpt-4o"
+	}
+
+	for backend, path := range map[string]string{
+		"assistants": "/openai/threads",
+		"chat":       "/openai/deployments/feedback-gpt-4o/chat/completions",
+	} {
+		t.Run(backend, func(t *testing.T) {
+			configure := []func(cfg *config.Config){azure}
+			if backend == "chat" {
+				configure = append([]func(cfg *config.Config){chatBackend}, azure)
+			}
+
+			e := setup(t, configure...)
+
+			e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+			e.drain(t)
+
+			if posts := e.posts(); len(posts) != 1 || !strings.HasPrefix(posts[0], "echo: ") {
+				t.Fatalf("unexpected posts %v", posts)
+			}
+
+			requests := e.openai.Requests()
+			if len(requests) == 0 || requests[0].Path != path {
+				t.Fatalf("expected first request to %s, got %v", path, requests)
+			}
+
+			for _, request := range requests {
+				if !strings.HasPrefix(request.Path, "/openai/") || request.Query.Get("api-version") != "2024-05-01-preview" {
+					t.Fatalf("unexpected url %s?%s", request.Path, request.Query.Encode())
+				}
+
+				if request.Header.Get("api-key") != "sk-test" || request.Header.Get("Authorization") != "" || request.Header.Get("OpenAI-Organization") != "" {
+					t.Fatalf("unexpected headers %v for %s", request.Header, request.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownCancelsInflightEvents(t *testing.T) {
+	e := setup(t)
+	e.openai.RunStatuses = []string{"queued", "in_progress"}
+
+	e.send(t, message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	eventually(t, func() bool { return len(e.slack.Calls("reactions.add")) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := e.handler.Shutdown(ctx); err == nil {
+		t.Fatal("expected shutdown to cancel the in-flight event")
+	}
+
+	posts := e.posts()
+	if len(posts) != 1 || posts[0] != router.SHUTDOWN_MESSAGE {
+		t.Fatalf("expected shutdown message, got %v", posts)
+	}
+
+	if len(e.slack.Calls("reactions.remove")) != 1 {
+		t.Fatal("expected thinking reaction to be removed")
+	}
+
+	if res := e.send(t, message("Ev2", "1700000000.000200", "", "Hello?")); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after shutdown, got %d", res.StatusCode)
+	}
+}
+
+func TestSocketModeAcknowledgesAcceptedEvents(t *testing.T) {
+	e := setup(t)
+
+	socket := testserver.NewSocket()
+	t.Cleanup(socket.Close)
+	e.slack.SocketUrl = socket.Url()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	e.handler.SetupSocketMode(ctx, slack.New(e.slack.URL, "xapp-test"))
+	eventually(t, func() bool { return socket.Connections() == 1 })
+
+	send := func(envelopeId, envelopeType string, payload I) {
+		if err := socket.Send(I{"envelope_id": envelopeId, "type": envelopeType, "payload": payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("1", "events_api", message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>"))
+	eventually(t, func() bool { return len(socket.Acks()) == 1 })
+	e.drain(t)
+
+	if len(e.slack.Calls("chat.postMessage")) != 1 {
+		t.Fatalf("expected an answer, got %v", e.posts())
+	}
+
+	// rejected while shutting down, so slack redelivers it. Envelopes are
+	// handled in order, once 3 is acknowledged 2 has been handled.
+	send("2", "events_api", message("Ev2", "1700000000.000200", "", "Hello?"))
+	send("3", "slash_commands", I{})
+	eventually(t, func() bool { return len(socket.Acks()) == 2 })
+
+	if acks := socket.Acks(); acks[0] != "1" || acks[1] != "3" {
+		t.Fatalf("expected the rejected envelope not to be acknowledged, got %v", acks)
+	}
+}
+
+// drainingEvents starts the shutdown while an event is marked as processed,
+// as if SIGTERM arrived between the dedup check and the queue
+type drainingEvents struct {
+	store.EventStore
+	handler *router.Handler
+}
+
+func (s *drainingEvents) MarkProcessed(eventId string, ttl time.Duration) (bool, error) {
+	seen, err := s.EventStore.MarkProcessed(eventId, ttl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.handler.Shutdown(ctx)
+
+	return seen, err
+}
+
+func TestRejectedEventIsNotMarkedAsDuplicate(t *testing.T) {
+	e := setup(t)
+	events := store.NewMemoryEventStore()
+	e.handler.Events = &drainingEvents{EventStore: events, handler: e.handler}
+
+	if res := e.send(t, message("Ev1", "1700000000.000100", "", "Hello?")); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 during shutdown, got %d", res.StatusCode)
+	}
+
+	for _, id := range []string{"Ev1", "message/D0CHANNEL/1700000000.000100"} {
+		if seen, _ := events.MarkProcessed(id, time.Hour); seen {
+			t.Fatalf("expected %s to be forgotten, so the retry is processed", id)
+		}
+	}
+}
+
+// install runs the OAuth flow in the browser's place and returns the final
+// response
+func (e *env) install(t *testing.T, code string) *http.Response {
+	t.Helper()
+
+	res, err := e.app.Test(httptest.NewRequest(http.MethodGet, "/slack/install", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), e.slack.URL+"/oauth/v2/authorize") {
+		t.Fatalf("unexpected redirect %q", res.Header.Get("Location"))
+	}
+
+	if location.Query().Get("client_id") != "C0CLIENT" || location.Query().Get("redirect_uri") != e.cfg.Slack.RedirectUrl {
+		t.Fatalf("unexpected authorize parameters %v", location.Query())
+	}
+
+	query := url.Values{"code": {code}, "state": {location.Query().Get("state")}}
+	req := httptest.NewRequest(http.MethodGet, "/slack/oauth_redirect?"+query.Encode(), nil)
+
+	for _, cookie := range res.Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	res, err = e.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func oauth(cfg *config.Config) {
+	cfg.Slack.ClientId = "C0CLIENT"
+	cfg.Slack.ClientSecret = "client-secret"
+	cfg.Slack.RedirectUrl = "https://example.com/slack/oauth_redirect"
+}
+
+func TestInstalledWorkspaceUsesItsToken(t *testing.T) {
+	e := setup(t, oauth)
+	e.handler.SetupOAuth(e.app, e.cfg.Slack)
+
+	install := &slack.OAuthAccess{AccessToken: "xoxb-other", BotUserId: "U0OTHERBOT"}
+	install.Team.Id = "T0OTHER"
+	install.Team.Name = "Other"
+	e.slack.Installs["code"] = install
+
+	res := e.install(t, "code")
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+
+	other := message("Ev1", "1700000000.000100", "", "Feedback for <@U0COLLEAGUE>")
+	other["team_id"] = "T0OTHER"
+	e.send(t, other)
+	eventually(t, func() bool { return len(e.slack.Calls("chat.postMessage")) == 1 })
+
+	// workspaces without installation fall back to SLACK_BOT_TOKEN
+	e.send(t, message("Ev2", "1700000000.000200", "", "Feedback for <@U0COLLEAGUE>"))
+	e.drain(t)
+
+	calls := e.slack.Calls("chat.postMessage")
+	if len(calls) != 2 || calls[0].Token != "xoxb-other" || calls[1].Token != "xoxb-test" {
+		t.Fatalf("unexpected tokens %v", calls)
+	}
+}
+
+func TestUninstalledWorkspaceIsForgotten(t *testing.T) {
+	e := setup(t, oauth)
+	e.handler.SetupOAuth(e.app, e.cfg.Slack)
+
+	install := &slack.OAuthAccess{AccessToken: "xoxb-other"}
+	install.Team.Id = "T0OTHER"
+	e.slack.Installs["code"] = install
+
+	e.install(t, "code")
+
+	e.send(t, I{
+		"type":     "event_callback",
+		"team_id":  "T0OTHER",
+		"event_id": "Ev1",
+		"event":    I{"type": "app_uninstalled"},
+	})
+
+	installation, err := e.handler.Installations.GetInstallation("T0OTHER")
+	if err != nil || installation != nil {
+		t.Fatalf("expected installation to be deleted, got %v %v", installation, err)
+	}
+}
+
+func TestOAuthRedirectRejectsInvalidState(t *testing.T) {
+	e := setup(t, oauth)
+	e.handler.SetupOAuth(e.app, e.cfg.Slack)
+
+	e.slack.Installs["code"] = &slack.OAuthAccess{AccessToken: "xoxb-other"}
+
+	req := httptest.NewRequest(http.MethodGet, "/slack/oauth_redirect?code=code&state=forged", nil)
+	req.AddCookie(&http.Cookie{Name: "slack_oauth_state", Value: "expected"})
+
+	res, err := e.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusBadRequest || len(e.slack.Calls("oauth.v2.access")) != 0 {
+		t.Fatalf("expected installation to be rejected, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/chat"
+)
+
+var SHUTDOWN_MESSAGE = ":arrows_counterclockwise: Sorry, i'm restarting right now. Please send your message again in a minute."
+
+// ErrShutdown is the cause of the context cancellation of events which didn't
+// finish in time during Shutdown.
+var ErrShutdown = errors.New("shutting down")
+
+// time granted to cancelled events to post SHUTDOWN_MESSAGE and clean up
+var shutdownGrace = 5 * time.Second
+
+// lifecycle tracks in-flight events, so they can be drained on shutdown.
+type lifecycle struct {
+	mu       sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+	cancel   context.CancelCauseFunc
+}
+
+// start returns the context events are processed with. It isn't cancelled
+// together with ctx but only by Shutdown, so in-flight events can finish.
+func (l *lifecycle) start(ctx context.Context) context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx, l.cancel = context.WithCancelCause(context.WithoutCancel(ctx))
+
+	return ctx
+}
+
+func (l *lifecycle) isDraining() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.draining
+}
+
+// acquire registers an in-flight event, it fails once Shutdown was called.
+func (l *lifecycle) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.draining {
+		return false
+	}
+
+	l.inflight.Add(1)
+
+	return true
+}
+
+func (l *lifecycle) release() {
+	l.inflight.Done()
+}
+
+// Shutdown stops accepting new events and waits for in-flight ones. If ctx is
+// done before, the remaining events are cancelled with ErrShutdown, so they
+// tell the user to retry and remove their reactions.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	l := &h.lifecycle
+
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	if l.cancel != nil {
+		l.cancel(ErrShutdown)
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+	}
+
+	return fmt.Errorf("cancelled in-flight events: %w", ctx.Err())
+}
+
+// Close releases the stores kept in files, call it after Shutdown.
+func (h *Handler) Close() error {
+	stores := []interface{}{h.Threads, h.Events, h.Replies, h.Installations, h.Counters, h.Usage}
+	if provider, ok := h.Provider.(*chat.Provider); ok {
+		stores = append(stores, provider.History)
+	}
+
+	var errs []error
+
+	for _, s := range stores {
+		if closer, ok := s.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// errorMessage picks the message shown to the user when processing failed.
+func (h *Handler) errorMessage(ctx context.Context) string {
+	if errors.Is(context.Cause(ctx), ErrShutdown) {
+		return SHUTDOWN_MESSAGE
+	}
+
+	return DEFAULT_ERROR_MESSAGE
+}
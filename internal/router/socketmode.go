@@ -0,0 +1,36 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/socketmode"
+)
+
+// SetupSocketMode receives events over Slack's Socket Mode instead of the
+// HTTP endpoint, so no public URL is needed. appClient must be created with
+// the app-level token. The connection is closed when ctx is done, in-flight
+// events are drained by Shutdown.
+// https://api.slack.com/apis/connections/socket-mode
+func (h *Handler) SetupSocketMode(ctx context.Context, appClient *slack.Client) {
+	eventCtx := h.lifecycle.start(ctx)
+
+	client := socketmode.New(appClient, h.Log, func(envelope *socketmode.Envelope) bool {
+		var body SlackRequestBody
+
+		if err := json.Unmarshal(envelope.Payload, &body); err != nil {
+			// a redelivery wouldn't decode either
+			h.Log.Error("Failed to decode socket mode payload", "error", err)
+			return true
+		}
+
+		h.Log.Info("Incoming Envelope", "envelope_id", envelope.EnvelopeId, "body", body)
+
+		// rejected during shutdown, slack redelivers it on another connection
+		return h.Dispatch(eventCtx, &body, strconv.Itoa(envelope.RetryAttempt), envelope.RetryReason)
+	})
+
+	go client.Run(ctx)
+}
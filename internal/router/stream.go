@@ -0,0 +1,48 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+)
+
+var STREAMING_PLACEHOLDER = ":writing_hand: …"
+
+// streamAnswer posts a placeholder into the slack thread and edits it while
+// OpenAI generates the answer, at most once per StreamingInterval as
+// chat.update is rate limited. Returns the ts of the posted message and the
+// complete answer, which the caller uses for the final update.
+// https://api.slack.com/methods/chat.update
+func (h *Handler) streamAnswer(ctx context.Context, channel, threadTs, openAiThreadId, content string, attachments ...openai.Attachment) (ts string, answer *openai.Answer, err error) {
+	res, err := h.Slack.AddToThread(ctx, STREAMING_PLACEHOLDER, channel, threadTs)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to post placeholder: %w", err)
+	}
+
+	if ts = messageTs(res); ts == "" {
+		return "", nil, fmt.Errorf("failed to post placeholder: %v", res)
+	}
+
+	var partial strings.Builder
+	lastUpdate := time.Now()
+
+	answer, err = h.Provider.SendMessageAndStreamAnswer(ctx, openAiThreadId, content, func(text string) {
+		partial.WriteString(text)
+
+		if time.Since(lastUpdate) < h.StreamingInterval {
+			return
+		}
+
+		lastUpdate = time.Now()
+		h.Slack.UpdateMessage(ctx, partial.String()+" …", channel, ts)
+	}, attachments...)
+	if err != nil {
+		h.Slack.UpdateMessage(context.WithoutCancel(ctx), h.errorMessage(ctx), channel, ts)
+		return ts, nil, fmt.Errorf("failed to send message and stream answer: %w", err)
+	}
+
+	return ts, answer, nil
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+)
+
+var EDIT_PROMPT = "I edited my last message, please answer this version instead:\n\n%s"
+
+// editedMessage returns the new version of a message_changed event or nil if
+// there is nothing to answer, e.g. Slack only added a link preview.
+// https://api.slack.com/events/message/message_changed
+func editedMessage(event *Event) *Event {
+	if event.Message == nil ||
+		event.Message.BotId != "" ||
+		event.Message.User == "" ||
+		(event.PreviousMessage != nil && event.PreviousMessage.Text == event.Message.Text) {
+		return nil
+	}
+
+	edited := *event.Message
+	edited.Channel = event.Channel
+	edited.ChannelType = event.ChannelType
+
+	return &edited
+}
+
+// deletedMessage returns the deleted message, the event itself only carries
+// its ts.
+// https://api.slack.com/events/message/message_deleted
+func deletedMessage(event *Event) *Event {
+	deleted := &Event{
+		Type:        event.Type,
+		Subtype:     event.Subtype,
+		Channel:     event.Channel,
+		ChannelType: event.ChannelType,
+		Ts:          event.DeletedTs,
+	}
+
+	if event.PreviousMessage != nil {
+		deleted.ThreadTs = event.PreviousMessage.ThreadTs
+	}
+
+	return deleted
+}
+
+// editChat answers the last question of a thread again after the user edited
+// it and replaces the previous answer. Edits of older messages are ignored,
+// the conversation has moved on since.
+func (h *Handler) editChat(ctx context.Context, event *Event) error {
+	cleanup := context.WithoutCancel(ctx)
+
+	threadTs := event.ThreadTs
+	if threadTs == "" {
+		threadTs = event.Ts
+	}
+
+	lastQuestion, err := h.Replies.GetLastQuestion(event.Channel, threadTs)
+	if err != nil {
+		return fmt.Errorf("failed to get last question: %w", err)
+	}
+
+	if lastQuestion != event.Ts {
+		return nil
+	}
+
+	replyTs, err := h.Replies.GetReply(event.Channel, event.Ts)
+	if err != nil {
+		return fmt.Errorf("failed to get reply: %w", err)
+	}
+
+	openAiThreadId, err := h.Threads.GetThread(event.Channel, threadTs)
+	if err != nil {
+		return fmt.Errorf("failed to get thread: %w", err)
+	}
+
+	if replyTs == "" || openAiThreadId == "" {
+		return nil
+	}
+
+	if h.limited(ctx, event) {
+		return nil
+	}
+
+	h.Slack.AddReactions(ctx, event.Channel, "thinking", event.Ts)
+	defer h.Slack.DelReactions(cleanup, event.Channel, "thinking", event.Ts)
+
+	ctx = withSlackThread(ctx, event)
+
+	openAiAnswer, err := h.Provider.SendMessageAndWaitForAnswer(ctx, openAiThreadId, fmt.Sprintf(EDIT_PROMPT, event.Text))
+	if err != nil {
+		h.Slack.AddToThread(cleanup, h.errorMessage(ctx), event.Channel, threadTs)
+		return fmt.Errorf("failed to send message and wait for answer: %w", err)
+	}
+
+	h.recordUsage(event, openAiAnswer)
+
+	// the first answer carries the aiThreadId
+	if event.Ts == threadTs {
+		_, err = h.Slack.UpdateThread(ctx, openAiAnswer.Text, event.Channel, replyTs, openAiThreadId)
+	} else {
+		_, err = h.Slack.UpdateMessage(ctx, openAiAnswer.Text, event.Channel, replyTs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update answer: %w", err)
+	}
+
+	return nil
+}
+
+// deleteChat removes the bot's answer to a deleted message.
+func (h *Handler) deleteChat(ctx context.Context, event *Event) error {
+	replyTs, err := h.Replies.GetReply(event.Channel, event.Ts)
+	if err != nil {
+		return fmt.Errorf("failed to get reply: %w", err)
+	}
+
+	if replyTs == "" {
+		return nil
+	}
+
+	if _, err := h.Slack.DeleteMessage(ctx, event.Channel, replyTs); err != nil {
+		return fmt.Errorf("failed to delete answer: %w", err)
+	}
+
+	if err := h.Replies.DeleteReply(event.Channel, event.Ts); err != nil {
+		return fmt.Errorf("failed to delete reply: %w", err)
+	}
+
+	return nil
+}
+
+// rememberReply records the answer to a question for editChat and deleteChat,
+// failing to do so only disables those.
+func (h *Handler) rememberReply(channel, threadTs, ts, replyTs string) {
+	if replyTs == "" {
+		return
+	}
+
+	if err := h.Replies.SetReply(channel, threadTs, ts, replyTs); err != nil {
+		h.Log.Error("Failed to store reply", "error", err)
+	}
+}
+
+// describeFiles lists shared files for the assistant, which can't open Slack
+// links itself.
+// https://api.slack.com/events/message/file_share
+func describeFiles(files []slack.File) string {
+	if len(files) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+
+	b.WriteString("\n\nShared files:")
+
+	for _, file := range files {
+		fmt.Fprintf(&b, "\n- %s (%s, %d bytes)", file.Name, file.Mimetype, file.Size)
+	}
+
+	return b.String()
+}
+
+func messageTs(res *slack.I) string {
+	if res == nil {
+		return ""
+	}
+
+	ts, _ := (*res)["ts"].(string)
+
+	return ts
+}
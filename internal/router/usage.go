@@ -0,0 +1,191 @@
+package router
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/config"
+	"github.com/dominikwinter/slackgpt/internal/store"
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/expvar"
+	"github.com/gofiber/fiber/v3/middleware/keyauth"
+)
+
+// recordUsage attributes the tokens of an answer to the event's user, channel
+// and workspace, for the report and the budgets. Answers without tokens, e.g.
+// of local models, still count as run. Failing to do so only costs accuracy.
+func (h *Handler) recordUsage(event *Event, answer *openai.Answer) {
+	h.chargeBudgets(event, answer)
+
+	err := h.Usage.AddUsage(store.Usage{
+		Month:            time.Now().UTC().Format("2006-01"),
+		TeamId:           event.Team,
+		UserId:           event.User,
+		Channel:          event.Channel,
+		Model:            answer.Model,
+		Runs:             1,
+		PromptTokens:     answer.Usage.PromptTokens,
+		CompletionTokens: answer.Usage.CompletionTokens,
+		TotalTokens:      answer.Usage.TotalTokens,
+	})
+	if err != nil {
+		h.Log.Error("Failed to store usage", "error", err)
+	}
+}
+
+// UsageRow is a line of the usage report, the columns not grouped by are
+// empty.
+type UsageRow struct {
+	Month            string  `json:"month"`
+	TeamId           string  `json:"team_id"`
+	UserId           string  `json:"user_id,omitempty"`
+	Channel          string  `json:"channel,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Runs             int     `json:"runs"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CostUsd          float64 `json:"cost_usd"`
+}
+
+// SetupUsage registers the usage report and the expvar counters on
+// /debug/vars, both authenticated by a bearer token of cfg.ApiKeys. Query
+// parameters of the report:
+//   - month: e.g. 2024-01, default the current month, "all" for every month
+//   - by: team (default), user, channel or model, the rows are per month,
+//     team and this column
+//   - format: json (default) or csv
+func (h *Handler) SetupUsage(app *fiber.App, cfg config.Usage) {
+	// validated on start
+	prices, _ := config.ParsePrices(cfg.Prices)
+
+	auth := keyauth.New(keyauth.Config{
+		Validator: func(c fiber.Ctx, key string) (bool, error) {
+			for _, apiKey := range cfg.ApiKeys {
+				if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		},
+	})
+
+	app.Get("/debug/vars", expvar.New(), auth)
+
+	app.Get(
+		"/api/v1/usage",
+		func(c fiber.Ctx) error {
+			month := c.Query("month", time.Now().UTC().Format("2006-01"))
+			if month == "all" {
+				month = ""
+			}
+
+			by := c.Query("by", "team")
+			if by != "team" && by != "user" && by != "channel" && by != "model" {
+				return c.Status(fiber.StatusBadRequest).SendString("by must be team, user, channel or model")
+			}
+
+			list, err := h.Usage.ListUsage(month)
+			if err != nil {
+				h.Log.Error("Failed to list usage", "error", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+
+			rows := usageReport(list, by, prices)
+
+			if c.Query("format") == "csv" {
+				c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+				c.Set(fiber.HeaderContentDisposition, `attachment; filename="usage.csv"`)
+
+				return writeUsageCsv(c, rows)
+			}
+
+			return c.JSON(fiber.Map{"rows": rows})
+		},
+		auth,
+	)
+}
+
+// usageReport sums up the usage per month, team and the by column. The cost
+// is calculated with the current prices, models without price cost nothing.
+func usageReport(list []store.Usage, by string, prices map[string]config.Price) []UsageRow {
+	rows := []UsageRow{}
+	index := map[string]int{}
+
+	for _, usage := range list {
+		row := UsageRow{Month: usage.Month, TeamId: usage.TeamId}
+
+		switch by {
+		case "user":
+			row.UserId = usage.UserId
+		case "channel":
+			row.Channel = usage.Channel
+		case "model":
+			row.Model = usage.Model
+		}
+
+		key := strings.Join([]string{row.Month, row.TeamId, row.UserId, row.Channel, row.Model}, "/")
+
+		i, ok := index[key]
+		if !ok {
+			i = len(rows)
+			index[key] = i
+			rows = append(rows, row)
+		}
+
+		rows[i].Runs += usage.Runs
+		rows[i].PromptTokens += usage.PromptTokens
+		rows[i].CompletionTokens += usage.CompletionTokens
+		rows[i].TotalTokens += usage.TotalTokens
+
+		if price, ok := priceOf(prices, usage.Model); ok {
+			rows[i].CostUsd += (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+		}
+	}
+
+	return rows
+}
+
+// priceOf matches dated model versions like gpt-4o-2024-05-13 by the longest
+// prefix, so gpt-4o-mini doesn't get the price of gpt-4o.
+func priceOf(prices map[string]config.Price, model string) (price config.Price, ok bool) {
+	longest := -1
+
+	for name, p := range prices {
+		if strings.HasPrefix(model, name) && len(name) > longest {
+			price, ok, longest = p, true, len(name)
+		}
+	}
+
+	return
+}
+
+func writeUsageCsv(c fiber.Ctx, rows []UsageRow) error {
+	w := csv.NewWriter(c)
+
+	w.Write([]string{"month", "team_id", "user_id", "channel", "model", "runs", "prompt_tokens", "completion_tokens", "total_tokens", "cost_usd"})
+
+	for _, row := range rows {
+		w.Write([]string{
+			row.Month,
+			row.TeamId,
+			row.UserId,
+			row.Channel,
+			row.Model,
+			strconv.Itoa(row.Runs),
+			strconv.Itoa(row.PromptTokens),
+			strconv.Itoa(row.CompletionTokens),
+			strconv.Itoa(row.TotalTokens),
+			strconv.FormatFloat(row.CostUsd, 'f', 6, 64),
+		})
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
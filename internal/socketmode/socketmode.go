@@ -0,0 +1,142 @@
+package socketmode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"golang.org/x/net/websocket"
+)
+
+// https://api.slack.com/apis/connections/socket-mode#events
+type Envelope struct {
+	EnvelopeId   string          `json:"envelope_id"`
+	Type         string          `json:"type"`
+	Reason       string          `json:"reason"`
+	RetryAttempt int             `json:"retry_attempt"`
+	RetryReason  string          `json:"retry_reason"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+type Ack struct {
+	EnvelopeId string `json:"envelope_id"`
+}
+
+// Handler is called for every "events_api" envelope and reports whether it
+// was accepted. Only accepted envelopes are acknowledged, Slack redelivers
+// the others.
+type Handler func(envelope *Envelope) bool
+
+// Client receives events over a WebSocket instead of the public HTTP
+// endpoint, so the bot can run without being reachable from the internet.
+type Client struct {
+	// Slack must be created with an app-level token (xapp-...)
+	Slack   *slack.Client
+	Origin  string
+	Log     *slog.Logger
+	Handler Handler
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func New(slackClient *slack.Client, log *slog.Logger, handler Handler) *Client {
+	return &Client{
+		Slack:      slackClient,
+		Origin:     "https://slack.com",
+		Log:        log,
+		Handler:    handler,
+		MinBackoff: time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// Run connects and reconnects until ctx is done.
+func (c *Client) Run(ctx context.Context) {
+	backoff := c.MinBackoff
+
+	for ctx.Err() == nil {
+		err := c.connect(ctx)
+		if err == nil {
+			// slack asked us to reconnect, e.g. "refresh_requested"
+			backoff = c.MinBackoff
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.Log.Error("Socket mode connection failed", "error", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, c.MaxBackoff)
+	}
+}
+
+// connect opens a single connection and reads envelopes until slack asks to
+// disconnect (nil error) or the connection breaks.
+func (c *Client) connect(ctx context.Context) error {
+	connection, err := c.Slack.OpenConnection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open connection: %w", err)
+	}
+
+	if !connection.Ok {
+		return fmt.Errorf("failed to open connection: %s", connection.Error)
+	}
+
+	config, err := websocket.NewConfig(connection.Url, c.Origin)
+	if err != nil {
+		return fmt.Errorf("failed to create websocket config: %w", err)
+	}
+
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to dial websocket: %w", err)
+	}
+	defer conn.Close()
+
+	// unblock Receive on shutdown
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for {
+		var envelope Envelope
+
+		if err := websocket.JSON.Receive(conn, &envelope); err != nil {
+			return fmt.Errorf("failed to receive envelope: %w", err)
+		}
+
+		switch envelope.Type {
+		case "hello":
+			c.Log.Info("Socket mode connected")
+
+		case "disconnect":
+			c.Log.Info("Socket mode disconnect requested", "reason", envelope.Reason)
+			return nil
+
+		default:
+			if envelope.Type == "events_api" && !c.Handler(&envelope) {
+				c.Log.Info("Socket mode envelope rejected", "envelope_id", envelope.EnvelopeId)
+				continue
+			}
+
+			// everything with an envelope id must be acknowledged within 3
+			// seconds, the handler only queues the event
+			if envelope.EnvelopeId != "" {
+				if err := websocket.JSON.Send(conn, Ack{EnvelopeId: envelope.EnvelopeId}); err != nil {
+					return fmt.Errorf("failed to acknowledge envelope: %w", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package socketmode_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/socketmode"
+	"github.com/dominikwinter/slackgpt/internal/testserver"
+)
+
+type I = map[string]interface{}
+
+// logs collects the client's log lines
+type logs struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logs) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.Write(p)
+}
+
+func (l *logs) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.String()
+}
+
+type env struct {
+	slack  *testserver.Slack
+	socket *testserver.Socket
+	logs   *logs
+
+	mu        sync.Mutex
+	envelopes []string
+	// returned by the handler
+	accept bool
+}
+
+// setup runs a client against the stand-ins until the test ends
+func setup(t *testing.T) *env {
+	t.Helper()
+
+	e := &env{
+		slack:  testserver.NewSlack(),
+		socket: testserver.NewSocket(),
+		logs:   &logs{},
+		accept: true,
+	}
+	t.Cleanup(e.slack.Close)
+	t.Cleanup(e.socket.Close)
+
+	e.slack.SocketUrl = e.socket.Url()
+
+	client := socketmode.New(
+		slack.New(e.slack.URL, "xapp-test"),
+		slog.New(slog.NewTextHandler(e.logs, nil)),
+		func(envelope *socketmode.Envelope) bool {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+
+			e.envelopes = append(e.envelopes, envelope.EnvelopeId+" "+string(envelope.Payload))
+
+			return e.accept
+		},
+	)
+	client.Origin = e.slack.URL
+	client.MinBackoff = time.Millisecond
+	client.MaxBackoff = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	eventually(t, func() bool { return e.socket.Connections() == 1 })
+
+	return e
+}
+
+func (e *env) handled() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string(nil), e.envelopes...)
+}
+
+func (e *env) send(t *testing.T, envelopeId string) {
+	t.Helper()
+
+	err := e.socket.Send(I{
+		"envelope_id": envelopeId,
+		"type":        "events_api",
+		"payload":     I{"event_id": "Ev" + envelopeId},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHelloIsNotHandled(t *testing.T) {
+	e := setup(t)
+
+	eventually(t, func() bool { return strings.Contains(e.logs.String(), "Socket mode connected") })
+
+	if len(e.handled()) != 0 || len(e.socket.Acks()) != 0 {
+		t.Fatalf("expected hello to be neither handled nor acknowledged, got %v", e.handled())
+	}
+
+	calls := e.slack.Calls("apps.connections.open")
+	if len(calls) != 1 || calls[0].Token != "xapp-test" {
+		t.Fatalf("expected the connection to be opened with the app token, got %v", calls)
+	}
+}
+
+func TestEventsAreHandledAndAcknowledged(t *testing.T) {
+	e := setup(t)
+
+	e.send(t, "1")
+	e.send(t, "2")
+	eventually(t, func() bool { return len(e.socket.Acks()) == 2 })
+
+	handled := e.handled()
+	if len(handled) != 2 || handled[0] != `1 {"event_id":"Ev1"}` || handled[1] != `2 {"event_id":"Ev2"}` {
+		t.Fatalf("unexpected envelopes %v", handled)
+	}
+
+	if acks := e.socket.Acks(); acks[0] != "1" || acks[1] != "2" {
+		t.Fatalf("unexpected acks %v", acks)
+	}
+}
+
+func TestRejectedEventsAreNotAcknowledged(t *testing.T) {
+	e := setup(t)
+
+	e.mu.Lock()
+	e.accept = false
+	e.mu.Unlock()
+
+	e.send(t, "1")
+	eventually(t, func() bool { return len(e.handled()) == 1 })
+
+	e.mu.Lock()
+	e.accept = true
+	e.mu.Unlock()
+
+	// acks are sent in order, once 2 is acknowledged 1 would have been too
+	e.send(t, "2")
+	eventually(t, func() bool { return len(e.socket.Acks()) == 1 })
+
+	if acks := e.socket.Acks(); acks[0] != "2" {
+		t.Fatalf("expected only the accepted envelope to be acknowledged, got %v", acks)
+	}
+}
+
+func TestDisconnectReconnects(t *testing.T) {
+	e := setup(t)
+
+	if err := e.socket.Disconnect("refresh_requested"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return e.socket.Connections() == 2 })
+
+	if !strings.Contains(e.logs.String(), "reason=refresh_requested") {
+		t.Fatalf("expected disconnect to be logged, got %s", e.logs.String())
+	}
+
+	if strings.Contains(e.logs.String(), "connection failed") {
+		t.Fatalf("expected a requested disconnect not to count as failure, got %s", e.logs.String())
+	}
+
+	// the new connection works
+	e.send(t, "1")
+	eventually(t, func() bool { return len(e.socket.Acks()) == 1 })
+
+	if len(e.slack.Calls("apps.connections.open")) != 2 {
+		t.Fatal("expected a new url for the second connection")
+	}
+}
+
+func TestLostConnectionReconnects(t *testing.T) {
+	e := setup(t)
+
+	e.socket.Drop()
+	eventually(t, func() bool { return e.socket.Connections() == 2 })
+
+	if !strings.Contains(e.logs.String(), "connection failed") {
+		t.Fatalf("expected the lost connection to be logged, got %s", e.logs.String())
+	}
+
+	e.send(t, "1")
+	eventually(t, func() bool { return len(e.socket.Acks()) == 1 })
+}
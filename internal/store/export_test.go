@@ -0,0 +1,55 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SetPruneInterval changes pruneInterval until the test ends.
+func SetPruneInterval(t *testing.T, interval time.Duration) {
+	old := pruneInterval
+	pruneInterval = interval
+	t.Cleanup(func() { pruneInterval = old })
+}
+
+// SetLockTimeout changes lockTimeout until the test ends.
+func SetLockTimeout(t *testing.T, timeout time.Duration) {
+	old := lockTimeout
+	lockTimeout = timeout
+	t.Cleanup(func() { lockTimeout = old })
+}
+
+// Len returns the number of stored event ids, expired ones included.
+func (s *MemoryEventStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.events)
+}
+
+func (s *FileEventStore) Len() int {
+	return s.file.len()
+}
+
+func (s *MemoryCounterStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.counters)
+}
+
+func (s *FileCounterStore) Len() int {
+	return s.file.len()
+}
+
+func (f *boltFile[V]) len() (n int) {
+	f.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
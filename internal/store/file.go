@@ -0,0 +1,467 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("store")
+
+// how long to wait for another process to release the lock of a file
+var lockTimeout = time.Second
+
+// boltFile keeps the values of a store JSON encoded in a bbolt database, keyed
+// like the memory stores. Every change is a transaction synced to disk before
+// it returns. bbolt locks the file while it is open, so a store belongs to a
+// single process, replicas need a path each.
+// https://github.com/etcd-io/bbolt
+type boltFile[V any] struct {
+	db   *bolt.DB
+	path string
+
+	mu       sync.Mutex
+	schedule pruneSchedule
+}
+
+// boltTx accesses the values within a transaction
+type boltTx[V any] struct {
+	bucket *bolt.Bucket
+}
+
+// newBoltFile creates the parent directory and the database.
+func newBoltFile[V any](path string) (*boltFile[V], error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	// fail instead of waiting for another process to release the lock
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: lockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("failed to open %s: locked by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	return &boltFile[V]{db: db, path: path}, nil
+}
+
+func (f *boltFile[V]) close() error {
+	return f.db.Close()
+}
+
+func (f *boltFile[V]) view(fn func(tx boltTx[V]) error) error {
+	return f.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx[V]{bucket: tx.Bucket(bucket)})
+	})
+}
+
+func (f *boltFile[V]) update(fn func(tx boltTx[V]) error) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return fmt.Errorf("failed to create bucket in %s: %w", f.path, err)
+		}
+
+		return fn(boltTx[V]{bucket: b})
+	})
+}
+
+func (f *boltFile[V]) get(key string) (value V, ok bool, err error) {
+	err = f.view(func(tx boltTx[V]) error {
+		value, ok, err = tx.get(key)
+		return err
+	})
+	return
+}
+
+// prune deletes the entries expired reports true for, unless that was done
+// within the last pruneInterval.
+func (f *boltFile[V]) prune(tx boltTx[V], expired func(value V) bool) error {
+	f.mu.Lock()
+	due := f.schedule.due(time.Now())
+	f.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	var keys []string
+
+	err := tx.each(func(key string, value V) error {
+		if expired(value) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := tx.delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t boltTx[V]) get(key string) (value V, ok bool, err error) {
+	// the bucket is created with the first write
+	if t.bucket == nil {
+		return
+	}
+
+	b := t.bucket.Get([]byte(key))
+	if b == nil {
+		return
+	}
+
+	if err = json.Unmarshal(b, &value); err != nil {
+		err = fmt.Errorf("failed to decode %s: %w", key, err)
+		return
+	}
+
+	return value, true, nil
+}
+
+func (t boltTx[V]) put(key string, value V) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+
+	return t.bucket.Put([]byte(key), b)
+}
+
+func (t boltTx[V]) delete(key string) error {
+	return t.bucket.Delete([]byte(key))
+}
+
+func (t boltTx[V]) each(fn func(key string, value V) error) error {
+	if t.bucket == nil {
+		return nil
+	}
+
+	return t.bucket.ForEach(func(k, b []byte) error {
+		var value V
+		if err := json.Unmarshal(b, &value); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", k, err)
+		}
+
+		return fn(string(k), value)
+	})
+}
+
+// FileThreadStore keeps the mapping in a database file on disk, so it
+// survives restarts.
+type FileThreadStore struct {
+	file *boltFile[string]
+}
+
+func NewFileThreadStore(path string) (*FileThreadStore, error) {
+	file, err := newBoltFile[string](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileThreadStore{file: file}, nil
+}
+
+// Close releases the file and its lock, the store can't be used afterwards.
+func (s *FileThreadStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileThreadStore) GetThread(channel, threadTs string) (string, error) {
+	aiThreadId, _, err := s.file.get(threadKey(channel, threadTs))
+	return aiThreadId, err
+}
+
+func (s *FileThreadStore) SetThread(channel, threadTs, aiThreadId string) error {
+	return s.file.update(func(tx boltTx[string]) error {
+		return tx.put(threadKey(channel, threadTs), aiThreadId)
+	})
+}
+
+// FileEventStore keeps processed event ids in a database file on disk, until
+// they expire.
+type FileEventStore struct {
+	file *boltFile[time.Time]
+}
+
+func NewFileEventStore(path string) (*FileEventStore, error) {
+	file, err := newBoltFile[time.Time](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileEventStore{file: file}, nil
+}
+
+func (s *FileEventStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileEventStore) MarkProcessed(eventId string, ttl time.Duration) (seen bool, err error) {
+	now := time.Now()
+
+	err = s.file.update(func(tx boltTx[time.Time]) error {
+		err := s.file.prune(tx, func(expires time.Time) bool { return now.After(expires) })
+		if err != nil {
+			return err
+		}
+
+		expires, ok, err := tx.get(eventId)
+		if err != nil {
+			return err
+		}
+
+		if seen = ok && !now.After(expires); seen {
+			return nil
+		}
+
+		return tx.put(eventId, now.Add(ttl))
+	})
+	return
+}
+
+func (s *FileEventStore) Forget(eventId string) error {
+	return s.file.update(func(tx boltTx[time.Time]) error {
+		return tx.delete(eventId)
+	})
+}
+
+// FileReplyStore keeps answers in a database file on disk.
+type FileReplyStore struct {
+	file *boltFile[string]
+}
+
+func NewFileReplyStore(path string) (*FileReplyStore, error) {
+	file, err := newBoltFile[string](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileReplyStore{file: file}, nil
+}
+
+func (s *FileReplyStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileReplyStore) GetReply(channel, ts string) (string, error) {
+	replyTs, _, err := s.file.get(threadKey(channel, ts))
+	return replyTs, err
+}
+
+func (s *FileReplyStore) GetLastQuestion(channel, threadTs string) (string, error) {
+	ts, _, err := s.file.get(lastQuestionKey(channel, threadTs))
+	return ts, err
+}
+
+func (s *FileReplyStore) SetReply(channel, threadTs, ts, replyTs string) error {
+	return s.file.update(func(tx boltTx[string]) error {
+		if err := tx.put(threadKey(channel, ts), replyTs); err != nil {
+			return err
+		}
+
+		return tx.put(lastQuestionKey(channel, threadTs), ts)
+	})
+}
+
+func (s *FileReplyStore) DeleteReply(channel, ts string) error {
+	return s.file.update(func(tx boltTx[string]) error {
+		return tx.delete(threadKey(channel, ts))
+	})
+}
+
+// FileInstallationStore keeps installations in a database file on disk. The
+// file holds bot tokens, keep it private.
+type FileInstallationStore struct {
+	file *boltFile[Installation]
+}
+
+func NewFileInstallationStore(path string) (*FileInstallationStore, error) {
+	file, err := newBoltFile[Installation](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInstallationStore{file: file}, nil
+}
+
+func (s *FileInstallationStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileInstallationStore) GetInstallation(teamId string) (*Installation, error) {
+	installation, ok, err := s.file.get(teamId)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return &installation, nil
+}
+
+func (s *FileInstallationStore) SetInstallation(installation *Installation) error {
+	return s.file.update(func(tx boltTx[Installation]) error {
+		return tx.put(installation.TeamId, *installation)
+	})
+}
+
+func (s *FileInstallationStore) DeleteInstallation(teamId string) error {
+	return s.file.update(func(tx boltTx[Installation]) error {
+		return tx.delete(teamId)
+	})
+}
+
+// FileCounterStore keeps counters in a database file on disk, so limits
+// survive restarts.
+type FileCounterStore struct {
+	file *boltFile[Counter]
+}
+
+func NewFileCounterStore(path string) (*FileCounterStore, error) {
+	file, err := newBoltFile[Counter](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileCounterStore{file: file}, nil
+}
+
+func (s *FileCounterStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileCounterStore) GetCounter(key string) (int, error) {
+	counter, _, err := s.file.get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.current(), nil
+}
+
+func (s *FileCounterStore) AddCounter(key string, n int, expires time.Time) (value int, err error) {
+	now := time.Now()
+
+	err = s.file.update(func(tx boltTx[Counter]) error {
+		err := s.file.prune(tx, func(counter Counter) bool { return now.After(counter.Expires) })
+		if err != nil {
+			return err
+		}
+
+		counter, _, err := tx.get(key)
+		if err != nil {
+			return err
+		}
+
+		if counter.current() == 0 {
+			counter = Counter{Expires: expires}
+		}
+
+		counter.Value += n
+		value = counter.Value
+
+		return tx.put(key, counter)
+	})
+	return
+}
+
+// FileUsageStore keeps usage in a database file on disk.
+type FileUsageStore struct {
+	file *boltFile[Usage]
+}
+
+func NewFileUsageStore(path string) (*FileUsageStore, error) {
+	file, err := newBoltFile[Usage](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileUsageStore{file: file}, nil
+}
+
+func (s *FileUsageStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileUsageStore) AddUsage(usage Usage) error {
+	return s.file.update(func(tx boltTx[Usage]) error {
+		key := usageKey(usage)
+
+		total, ok, err := tx.get(key)
+		if err != nil {
+			return err
+		}
+
+		totals := map[string]Usage{}
+		if ok {
+			totals[key] = total
+		}
+
+		addUsage(totals, usage)
+
+		return tx.put(key, totals[key])
+	})
+}
+
+func (s *FileUsageStore) ListUsage(month string) ([]Usage, error) {
+	totals := map[string]Usage{}
+
+	err := s.file.view(func(tx boltTx[Usage]) error {
+		return tx.each(func(key string, usage Usage) error {
+			totals[key] = usage
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return listUsage(totals, month), nil
+}
+
+// FileHistoryStore keeps conversations in a database file on disk.
+type FileHistoryStore struct {
+	file *boltFile[[]json.RawMessage]
+}
+
+func NewFileHistoryStore(path string) (*FileHistoryStore, error) {
+	file, err := newBoltFile[[]json.RawMessage](path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileHistoryStore{file: file}, nil
+}
+
+func (s *FileHistoryStore) Close() error {
+	return s.file.close()
+}
+
+func (s *FileHistoryStore) GetHistory(threadId string) ([]json.RawMessage, error) {
+	messages, _, err := s.file.get(threadId)
+	return messages, err
+}
+
+func (s *FileHistoryStore) AppendHistory(threadId string, messages ...json.RawMessage) error {
+	return s.file.update(func(tx boltTx[[]json.RawMessage]) error {
+		history, _, err := tx.get(threadId)
+		if err != nil {
+			return err
+		}
+
+		return tx.put(threadId, append(history, messages...))
+	})
+}
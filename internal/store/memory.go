@@ -0,0 +1,306 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryThreadStore keeps the mapping in process memory only. Useful for tests
+// and local development, everything is lost on restart.
+type MemoryThreadStore struct {
+	mu      sync.RWMutex
+	threads map[string]string
+}
+
+func NewMemoryThreadStore() *MemoryThreadStore {
+	return &MemoryThreadStore{threads: map[string]string{}}
+}
+
+func (s *MemoryThreadStore) GetThread(channel, threadTs string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.threads[threadKey(channel, threadTs)], nil
+}
+
+func (s *MemoryThreadStore) SetThread(channel, threadTs, aiThreadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.threads[threadKey(channel, threadTs)] = aiThreadId
+
+	return nil
+}
+
+// MemoryEventStore keeps processed event ids in process memory only.
+type MemoryEventStore struct {
+	mu       sync.Mutex
+	events   map[string]time.Time
+	schedule pruneSchedule
+}
+
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{events: map[string]time.Time{}}
+}
+
+func (s *MemoryEventStore) MarkProcessed(eventId string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// expired ids are dropped, so the map doesn't grow forever
+	now := time.Now()
+
+	if s.schedule.due(now) {
+		for id, expires := range s.events {
+			if now.After(expires) {
+				delete(s.events, id)
+			}
+		}
+	}
+
+	if expires, ok := s.events[eventId]; ok && !now.After(expires) {
+		return true, nil
+	}
+
+	s.events[eventId] = now.Add(ttl)
+
+	return false, nil
+}
+
+func (s *MemoryEventStore) Forget(eventId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.events, eventId)
+
+	return nil
+}
+
+// MemoryReplyStore keeps answers in process memory only.
+type MemoryReplyStore struct {
+	mu      sync.RWMutex
+	replies map[string]string
+}
+
+func NewMemoryReplyStore() *MemoryReplyStore {
+	return &MemoryReplyStore{replies: map[string]string{}}
+}
+
+func (s *MemoryReplyStore) GetReply(channel, ts string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.replies[threadKey(channel, ts)], nil
+}
+
+func (s *MemoryReplyStore) GetLastQuestion(channel, threadTs string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.replies[lastQuestionKey(channel, threadTs)], nil
+}
+
+func (s *MemoryReplyStore) SetReply(channel, threadTs, ts, replyTs string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setReply(s.replies, channel, threadTs, ts, replyTs)
+
+	return nil
+}
+
+func (s *MemoryReplyStore) DeleteReply(channel, ts string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.replies, threadKey(channel, ts))
+
+	return nil
+}
+
+// setReply stores both lookups in one map, the last question under a prefixed
+// key.
+func setReply(replies map[string]string, channel, threadTs, ts, replyTs string) {
+	replies[threadKey(channel, ts)] = replyTs
+	replies[lastQuestionKey(channel, threadTs)] = ts
+}
+
+// MemoryInstallationStore keeps installations in process memory only, every
+// workspace has to reinstall the app after a restart.
+type MemoryInstallationStore struct {
+	mu            sync.RWMutex
+	installations map[string]Installation
+}
+
+func NewMemoryInstallationStore() *MemoryInstallationStore {
+	return &MemoryInstallationStore{installations: map[string]Installation{}}
+}
+
+func (s *MemoryInstallationStore) GetInstallation(teamId string) (*Installation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	installation, ok := s.installations[teamId]
+	if !ok {
+		return nil, nil
+	}
+
+	return &installation, nil
+}
+
+func (s *MemoryInstallationStore) SetInstallation(installation *Installation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.installations[installation.TeamId] = *installation
+
+	return nil
+}
+
+func (s *MemoryInstallationStore) DeleteInstallation(teamId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.installations, teamId)
+
+	return nil
+}
+
+// MemoryCounterStore keeps counters in process memory only, limits start over
+// on restart.
+type MemoryCounterStore struct {
+	mu       sync.Mutex
+	counters map[string]Counter
+	schedule pruneSchedule
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{counters: map[string]Counter{}}
+}
+
+func (s *MemoryCounterStore) GetCounter(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counters[key].current(), nil
+}
+
+func (s *MemoryCounterStore) AddCounter(key string, n int, expires time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// expired counters are dropped, so the map doesn't grow forever
+	now := time.Now()
+
+	if s.schedule.due(now) {
+		for k, counter := range s.counters {
+			if now.After(counter.Expires) {
+				delete(s.counters, k)
+			}
+		}
+	}
+
+	counter := s.counters[key]
+	if counter.current() == 0 {
+		counter = Counter{Expires: expires}
+	}
+
+	counter.Value += n
+	s.counters[key] = counter
+
+	return counter.Value, nil
+}
+
+// MemoryUsageStore keeps usage in process memory only, it is lost on restart.
+type MemoryUsageStore struct {
+	mu    sync.RWMutex
+	usage map[string]Usage
+}
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{usage: map[string]Usage{}}
+}
+
+func (s *MemoryUsageStore) AddUsage(usage Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addUsage(s.usage, usage)
+
+	return nil
+}
+
+func (s *MemoryUsageStore) ListUsage(month string) ([]Usage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return listUsage(s.usage, month), nil
+}
+
+func usageKey(usage Usage) string {
+	return strings.Join([]string{usage.Month, usage.TeamId, usage.UserId, usage.Channel, usage.Model}, "/")
+}
+
+func addUsage(totals map[string]Usage, usage Usage) {
+	key := usageKey(usage)
+
+	total, ok := totals[key]
+	if !ok {
+		total = usage
+	} else {
+		total.Runs += usage.Runs
+		total.PromptTokens += usage.PromptTokens
+		total.CompletionTokens += usage.CompletionTokens
+		total.TotalTokens += usage.TotalTokens
+	}
+
+	totals[key] = total
+}
+
+func listUsage(totals map[string]Usage, month string) []Usage {
+	keys := make([]string, 0, len(totals))
+	for key, usage := range totals {
+		if month == "" || usage.Month == month {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	list := make([]Usage, len(keys))
+	for i, key := range keys {
+		list[i] = totals[key]
+	}
+
+	return list
+}
+
+// MemoryHistoryStore keeps conversations in process memory only, they are
+// lost on restart.
+type MemoryHistoryStore struct {
+	mu      sync.RWMutex
+	history map[string][]json.RawMessage
+}
+
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{history: map[string][]json.RawMessage{}}
+}
+
+func (s *MemoryHistoryStore) GetHistory(threadId string) ([]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]json.RawMessage(nil), s.history[threadId]...), nil
+}
+
+func (s *MemoryHistoryStore) AppendHistory(threadId string, messages ...json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history[threadId] = append(s.history[threadId], messages...)
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ThreadStore maps a Slack thread (channel + thread_ts) to the OpenAI thread
+// holding the conversation. Implementations must be safe for concurrent use.
+type ThreadStore interface {
+	// GetThread returns the OpenAI thread id or an empty string if the Slack
+	// thread is unknown.
+	GetThread(channel, threadTs string) (string, error)
+	SetThread(channel, threadTs, aiThreadId string) error
+}
+
+// EventStore remembers processed Slack event ids for a limited time to drop
+// redelivered events. Implementations must be safe for concurrent use.
+type EventStore interface {
+	// MarkProcessed records the event id and reports whether it has already
+	// been recorded within the last ttl.
+	MarkProcessed(eventId string, ttl time.Duration) (seen bool, err error)
+	// Forget removes the event id again, so a redelivery is processed.
+	Forget(eventId string) error
+}
+
+// ReplyStore remembers the bot's answer to each user message and the last
+// answered message per thread, so edits and deletions of a question can be
+// applied to its answer. Implementations must be safe for concurrent use.
+type ReplyStore interface {
+	// GetReply returns the ts of the answer or an empty string.
+	GetReply(channel, ts string) (string, error)
+	// GetLastQuestion returns the ts of the last answered message in the
+	// thread or an empty string.
+	GetLastQuestion(channel, threadTs string) (string, error)
+	SetReply(channel, threadTs, ts, replyTs string) error
+	DeleteReply(channel, ts string) error
+}
+
+// Installation is a workspace the app was installed to via OAuth.
+type Installation struct {
+	TeamId      string    `json:"team_id"`
+	TeamName    string    `json:"team_name"`
+	AppId       string    `json:"app_id"`
+	BotUserId   string    `json:"bot_user_id"`
+	BotToken    string    `json:"bot_token"`
+	Scope       string    `json:"scope"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// InstallationStore keeps the bot token of every workspace, keyed by team id.
+// Implementations must be safe for concurrent use.
+type InstallationStore interface {
+	// GetInstallation returns nil if the app isn't installed in the team.
+	GetInstallation(teamId string) (*Installation, error)
+	SetInstallation(installation *Installation) error
+	DeleteInstallation(teamId string) error
+}
+
+// Counter is a number that is dropped once it expires, e.g. the tokens used
+// by a user today.
+type Counter struct {
+	Value   int       `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// current returns 0 once the counter expired
+func (c Counter) current() int {
+	if time.Now().After(c.Expires) {
+		return 0
+	}
+
+	return c.Value
+}
+
+// CounterStore keeps the counters of rate limits and budgets.
+// Implementations must be safe for concurrent use.
+type CounterStore interface {
+	// GetCounter returns 0 for unknown and expired counters.
+	GetCounter(key string) (int, error)
+	// AddCounter adds n and returns the new value, a new counter expires at
+	// expires.
+	AddCounter(key string, n int, expires time.Time) (int, error)
+}
+
+// Usage sums up the OpenAI tokens a user spent in a channel with a model
+// within a month.
+type Usage struct {
+	// e.g. 2024-01
+	Month            string `json:"month"`
+	TeamId           string `json:"team_id"`
+	UserId           string `json:"user_id"`
+	Channel          string `json:"channel"`
+	Model            string `json:"model"`
+	Runs             int    `json:"runs"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+}
+
+// UsageStore keeps the totals of every month, team, user, channel and model.
+// Implementations must be safe for concurrent use.
+type UsageStore interface {
+	// AddUsage adds the runs and tokens of usage to its totals.
+	AddUsage(usage Usage) error
+	// ListUsage returns the totals of a month, of all months if month is
+	// empty, sorted by month, team, user, channel and model.
+	ListUsage(month string) ([]Usage, error)
+}
+
+// HistoryStore keeps the messages of conversations with backends that are
+// stateless, keyed by thread id. The messages are opaque JSON documents.
+// Implementations must be safe for concurrent use.
+type HistoryStore interface {
+	// GetHistory returns the messages oldest first, none for unknown threads.
+	GetHistory(threadId string) ([]json.RawMessage, error)
+	AppendHistory(threadId string, messages ...json.RawMessage) error
+}
+
+// expired entries are deleted at most this often, as it reads every entry
+var pruneInterval = time.Minute
+
+// pruneSchedule tells when expired entries are due for deletion. It isn't safe
+// for concurrent use.
+type pruneSchedule struct {
+	last time.Time
+}
+
+func (p *pruneSchedule) due(now time.Time) bool {
+	if now.Sub(p.last) < pruneInterval {
+		return false
+	}
+
+	p.last = now
+
+	return true
+}
+
+func threadKey(channel, threadTs string) string {
+	return channel + "/" + threadTs
+}
+
+func lastQuestionKey(channel, threadTs string) string {
+	return "last/" + threadKey(channel, threadTs)
+}
@@ -0,0 +1,437 @@
+package store_test
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/store"
+)
+
+type eventStore interface {
+	store.EventStore
+	Len() int
+}
+
+// both returns memory and an empty file store, closed when the test ends
+func both[S any](t *testing.T, memory S, newFile func(path string) (S, error)) map[string]S {
+	t.Helper()
+
+	file, err := newFile(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { any(file).(io.Closer).Close() })
+
+	return map[string]S{"memory": memory, "file": file}
+}
+
+func eventStores(t *testing.T) map[string]eventStore {
+	return both(t, eventStore(store.NewMemoryEventStore()), func(path string) (eventStore, error) {
+		return store.NewFileEventStore(path)
+	})
+}
+
+func mark(t *testing.T, s store.EventStore, eventId string, ttl time.Duration) bool {
+	t.Helper()
+
+	seen, err := s.MarkProcessed(eventId, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return seen
+}
+
+func TestEventStoreRemembersAndForgets(t *testing.T) {
+	for name, s := range eventStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if mark(t, s, "Ev1", time.Hour) {
+				t.Fatal("expected a new event")
+			}
+
+			if !mark(t, s, "Ev1", time.Hour) || mark(t, s, "Ev2", time.Hour) {
+				t.Fatal("expected only Ev1 to be seen")
+			}
+
+			if err := s.Forget("Ev1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if mark(t, s, "Ev1", time.Hour) || !mark(t, s, "Ev1", time.Hour) {
+				t.Fatal("expected a forgotten event to be marked again")
+			}
+		})
+	}
+}
+
+func TestEventStoreExpires(t *testing.T) {
+	for name, s := range eventStores(t) {
+		t.Run(name, func(t *testing.T) {
+			mark(t, s, "Ev1", time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+
+			if mark(t, s, "Ev1", time.Hour) {
+				t.Fatal("expected an expired event to be new")
+			}
+
+			if !mark(t, s, "Ev1", time.Hour) {
+				t.Fatal("expected the event to be marked again after expiry")
+			}
+		})
+	}
+}
+
+func TestEventStorePrunesOncePerInterval(t *testing.T) {
+	store.SetPruneInterval(t, time.Hour)
+
+	for name, s := range eventStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// prunes the empty store, the next time in an hour
+			mark(t, s, "Ev1", time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+
+			mark(t, s, "Ev2", time.Hour)
+			if s.Len() != 2 {
+				t.Fatalf("expected the expired event to be kept until the next prune, got %d", s.Len())
+			}
+
+			store.SetPruneInterval(t, 0)
+
+			mark(t, s, "Ev3", time.Hour)
+			if s.Len() != 2 {
+				t.Fatalf("expected the expired event to be pruned, got %d", s.Len())
+			}
+		})
+	}
+}
+
+func TestThreadStore(t *testing.T) {
+	stores := both(t, store.ThreadStore(store.NewMemoryThreadStore()), func(path string) (store.ThreadStore, error) {
+		return store.NewFileThreadStore(path)
+	})
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if id, err := s.GetThread("C1", "1.0"); id != "" || err != nil {
+				t.Fatalf("expected an unknown thread, got %q %v", id, err)
+			}
+
+			if err := s.SetThread("C1", "1.0", "thread_1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if id, err := s.GetThread("C1", "1.0"); id != "thread_1" || err != nil {
+				t.Fatalf("expected thread_1, got %q %v", id, err)
+			}
+		})
+	}
+}
+
+func TestReplyStore(t *testing.T) {
+	stores := both(t, store.ReplyStore(store.NewMemoryReplyStore()), func(path string) (store.ReplyStore, error) {
+		return store.NewFileReplyStore(path)
+	})
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if err := s.SetReply("C1", "1.0", "1.1", "1.2"); err != nil {
+				t.Fatal(err)
+			}
+
+			reply, _ := s.GetReply("C1", "1.1")
+			last, _ := s.GetLastQuestion("C1", "1.0")
+			if reply != "1.2" || last != "1.1" {
+				t.Fatalf("expected reply 1.2 to question 1.1, got %q %q", reply, last)
+			}
+
+			if err := s.DeleteReply("C1", "1.1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if reply, _ := s.GetReply("C1", "1.1"); reply != "" {
+				t.Fatalf("expected the reply to be deleted, got %q", reply)
+			}
+		})
+	}
+}
+
+func TestInstallationStore(t *testing.T) {
+	stores := both(t, store.InstallationStore(store.NewMemoryInstallationStore()), func(path string) (store.InstallationStore, error) {
+		return store.NewFileInstallationStore(path)
+	})
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if installation, err := s.GetInstallation("T1"); installation != nil || err != nil {
+				t.Fatalf("expected no installation, got %v %v", installation, err)
+			}
+
+			want := store.Installation{TeamId: "T1", TeamName: "Team", BotToken: "xoxb-1", InstalledAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			if err := s.SetInstallation(&want); err != nil {
+				t.Fatal(err)
+			}
+
+			if installation, _ := s.GetInstallation("T1"); installation == nil || *installation != want {
+				t.Fatalf("expected %v, got %v", want, installation)
+			}
+
+			if err := s.DeleteInstallation("T1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if installation, _ := s.GetInstallation("T1"); installation != nil {
+				t.Fatalf("expected the installation to be deleted, got %v", installation)
+			}
+		})
+	}
+}
+
+type counterStore interface {
+	store.CounterStore
+	Len() int
+}
+
+func counterStores(t *testing.T) map[string]counterStore {
+	return both(t, counterStore(store.NewMemoryCounterStore()), func(path string) (counterStore, error) {
+		return store.NewFileCounterStore(path)
+	})
+}
+
+func add(t *testing.T, s store.CounterStore, key string, n int, expires time.Time) int {
+	t.Helper()
+
+	value, err := s.AddCounter(key, n, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestCounterStore(t *testing.T) {
+	for name, s := range counterStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tomorrow := time.Now().Add(24 * time.Hour)
+
+			if value, err := s.GetCounter("a"); value != 0 || err != nil {
+				t.Fatalf("expected 0 for an unknown counter, got %d %v", value, err)
+			}
+
+			if add(t, s, "a", 2, tomorrow) != 2 || add(t, s, "a", 3, tomorrow) != 5 || add(t, s, "b", 1, tomorrow) != 1 {
+				t.Fatal("expected the counters to add up separately")
+			}
+
+			add(t, s, "c", 1, time.Now().Add(time.Millisecond))
+			time.Sleep(2 * time.Millisecond)
+
+			if value, _ := s.GetCounter("c"); value != 0 {
+				t.Fatalf("expected an expired counter to be 0, got %d", value)
+			}
+
+			if add(t, s, "c", 1, tomorrow) != 1 {
+				t.Fatal("expected an expired counter to start again")
+			}
+		})
+	}
+}
+
+func TestCounterStorePrunesOncePerInterval(t *testing.T) {
+	store.SetPruneInterval(t, time.Hour)
+
+	for name, s := range counterStores(t) {
+		t.Run(name, func(t *testing.T) {
+			add(t, s, "a", 1, time.Now().Add(time.Millisecond))
+			time.Sleep(2 * time.Millisecond)
+
+			add(t, s, "b", 1, time.Now().Add(time.Hour))
+			if s.Len() != 2 {
+				t.Fatalf("expected the expired counter to be kept until the next prune, got %d", s.Len())
+			}
+
+			store.SetPruneInterval(t, 0)
+
+			add(t, s, "c", 1, time.Now().Add(time.Hour))
+			if s.Len() != 2 {
+				t.Fatalf("expected the expired counter to be pruned, got %d", s.Len())
+			}
+		})
+	}
+}
+
+func TestUsageStore(t *testing.T) {
+	stores := both(t, store.UsageStore(store.NewMemoryUsageStore()), func(path string) (store.UsageStore, error) {
+		return store.NewFileUsageStore(path)
+	})
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, usage := range []store.Usage{
+				{Month: "2024-02", TeamId: "T1", UserId: "U1", Model: "gpt-4o", Runs: 1, TotalTokens: 10},
+				{Month: "2024-01", TeamId: "T1", UserId: "U1", Model: "gpt-4o", Runs: 1, PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+				{Month: "2024-01", TeamId: "T1", UserId: "U1", Model: "gpt-4o", Runs: 1, PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2},
+			} {
+				if err := s.AddUsage(usage); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			january, _ := s.ListUsage("2024-01")
+			want := store.Usage{Month: "2024-01", TeamId: "T1", UserId: "U1", Model: "gpt-4o", Runs: 2, PromptTokens: 4, CompletionTokens: 3, TotalTokens: 7}
+			if len(january) != 1 || january[0] != want {
+				t.Fatalf("expected the totals of January, got %v", january)
+			}
+
+			if all, _ := s.ListUsage(""); len(all) != 2 || all[0].Month != "2024-01" || all[1].Month != "2024-02" {
+				t.Fatalf("expected all months sorted, got %v", all)
+			}
+		})
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	stores := both(t, store.HistoryStore(store.NewMemoryHistoryStore()), func(path string) (store.HistoryStore, error) {
+		return store.NewFileHistoryStore(path)
+	})
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if messages, err := s.GetHistory("thread_1"); len(messages) != 0 || err != nil {
+				t.Fatalf("expected no messages, got %s %v", messages, err)
+			}
+
+			s.AppendHistory("thread_1", json.RawMessage(`{"role":"user"}`))
+			s.AppendHistory("thread_1", json.RawMessage(`{"role":"assistant"}`), json.RawMessage(`{"role":"user"}`))
+
+			messages, _ := s.GetHistory("thread_1")
+			want := []json.RawMessage{json.RawMessage(`{"role":"user"}`), json.RawMessage(`{"role":"assistant"}`), json.RawMessage(`{"role":"user"}`)}
+			if !reflect.DeepEqual(messages, want) {
+				t.Fatalf("expected the messages oldest first, got %s", messages)
+			}
+		})
+	}
+}
+
+func TestFileStoresPersistAcrossReopen(t *testing.T) {
+	for name, test := range map[string]struct {
+		open  func(path string) (io.Closer, error)
+		write func(s io.Closer) error
+		read  func(s io.Closer) (ok bool, err error)
+	}{
+		"threads": {
+			func(path string) (io.Closer, error) { return store.NewFileThreadStore(path) },
+			func(s io.Closer) error { return s.(store.ThreadStore).SetThread("C1", "1.0", "thread_1") },
+			func(s io.Closer) (bool, error) {
+				id, err := s.(store.ThreadStore).GetThread("C1", "1.0")
+				return id == "thread_1", err
+			},
+		},
+		"events": {
+			func(path string) (io.Closer, error) { return store.NewFileEventStore(path) },
+			func(s io.Closer) error { _, err := s.(store.EventStore).MarkProcessed("Ev1", time.Hour); return err },
+			func(s io.Closer) (bool, error) { return s.(store.EventStore).MarkProcessed("Ev1", time.Hour) },
+		},
+		"replies": {
+			func(path string) (io.Closer, error) { return store.NewFileReplyStore(path) },
+			func(s io.Closer) error { return s.(store.ReplyStore).SetReply("C1", "1.0", "1.1", "1.2") },
+			func(s io.Closer) (bool, error) {
+				reply, err := s.(store.ReplyStore).GetReply("C1", "1.1")
+				return reply == "1.2", err
+			},
+		},
+		"installations": {
+			func(path string) (io.Closer, error) { return store.NewFileInstallationStore(path) },
+			func(s io.Closer) error {
+				return s.(store.InstallationStore).SetInstallation(&store.Installation{TeamId: "T1", BotToken: "xoxb-1"})
+			},
+			func(s io.Closer) (bool, error) {
+				installation, err := s.(store.InstallationStore).GetInstallation("T1")
+				return installation != nil && installation.BotToken == "xoxb-1", err
+			},
+		},
+		"counters": {
+			func(path string) (io.Closer, error) { return store.NewFileCounterStore(path) },
+			func(s io.Closer) error {
+				_, err := s.(store.CounterStore).AddCounter("a", 3, time.Now().Add(time.Hour))
+				return err
+			},
+			func(s io.Closer) (bool, error) {
+				value, err := s.(store.CounterStore).GetCounter("a")
+				return value == 3, err
+			},
+		},
+		"usage": {
+			func(path string) (io.Closer, error) { return store.NewFileUsageStore(path) },
+			func(s io.Closer) error {
+				return s.(store.UsageStore).AddUsage(store.Usage{Month: "2024-01", TeamId: "T1", Runs: 1})
+			},
+			func(s io.Closer) (bool, error) {
+				list, err := s.(store.UsageStore).ListUsage("")
+				return len(list) == 1 && list[0].Runs == 1, err
+			},
+		},
+		"history": {
+			func(path string) (io.Closer, error) { return store.NewFileHistoryStore(path) },
+			func(s io.Closer) error {
+				return s.(store.HistoryStore).AppendHistory("thread_1", json.RawMessage(`{}`))
+			},
+			func(s io.Closer) (bool, error) {
+				messages, err := s.(store.HistoryStore).GetHistory("thread_1")
+				return len(messages) == 1, err
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data", name+".db")
+
+			s, err := test.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := test.write(s); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = test.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if ok, err := test.read(s); !ok || err != nil {
+				t.Fatalf("expected the value to survive reopening, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreIsLockedByItsProcess(t *testing.T) {
+	store.SetLockTimeout(t, 10*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "threads.db")
+
+	s, err := store.NewFileThreadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.NewFileThreadStore(path); err == nil || !strings.Contains(err.Error(), "locked by another process") {
+		t.Fatalf("expected the second open to fail, got %v", err)
+	}
+
+	s.Close()
+
+	s, err = store.NewFileThreadStore(path)
+	if err != nil {
+		t.Fatalf("expected the lock to be released on close, got %v", err)
+	}
+	s.Close()
+}
@@ -0,0 +1,603 @@
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+)
+
+type message struct {
+	Id          string `json:"id"`
+	Role        string `json:"role"`
+	Content     []I    `json:"content"`
+	Attachments []I    `json:"attachments,omitempty"`
+}
+
+// File is an uploaded file.
+type File struct {
+	Id       string
+	Filename string
+	Purpose  string
+	Content  []byte
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Time   time.Time
+}
+
+type run struct {
+	Id             string                 `json:"id"`
+	ThreadId       string                 `json:"thread_id"`
+	Status         string                 `json:"status"`
+	Model          string                 `json:"model"`
+	RequiredAction *openai.RequiredAction `json:"required_action,omitempty"`
+	LastError      *openai.RunLastError   `json:"last_error"`
+	Usage          *openai.Usage          `json:"usage"`
+
+	statuses []string
+	step     int
+}
+
+// OpenAI fakes the threads, messages and runs endpoints of the Assistants
+// API and the Chat Completions API. Every run goes through RunStatuses, one
+// status per retrieval, and adds the assistant message once it reaches
+// "completed". Chat completions call ToolCalls once per user message.
+type OpenAI struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	ids         int
+	threads     map[string][]message
+	runs        map[string]*run
+	toolOutputs []openai.ToolOutput
+	files       []File
+	chats       [][]string
+	assistants  []I
+	requests    []Request
+
+	// statuses of a new run, default queued, in_progress, completed. Runs stay
+	// in "requires_action" until the tool outputs are submitted.
+	RunStatuses []string
+	// tool calls of runs in "requires_action"
+	ToolCalls []openai.ToolCall
+	// generates the assistant message, default echoes the last user message
+	Answer func(threadId, content string) string
+	// reported by every completed run
+	Usage openai.Usage
+	// reported by runs ending failed or expired
+	LastError *openai.RunLastError
+}
+
+func NewOpenAI() *OpenAI {
+	o := &OpenAI{
+		threads: map[string][]message{},
+		runs:    map[string]*run{},
+	}
+
+	o.Server = httptest.NewServer(http.HandlerFunc(o.handle))
+
+	return o
+}
+
+// Messages returns the user and assistant messages of a thread, oldest first.
+func (o *OpenAI) Messages(threadId string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var contents []string
+	for _, m := range o.threads[threadId] {
+		contents = append(contents, m.Role+": "+text(m))
+	}
+
+	return contents
+}
+
+func (o *OpenAI) Threads() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.threads)
+}
+
+// ThreadIds returns the ids of all threads, sorted.
+func (o *OpenAI) ThreadIds() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var ids []string
+	for id := range o.threads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (o *OpenAI) ToolOutputs() []openai.ToolOutput {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]openai.ToolOutput(nil), o.toolOutputs...)
+}
+
+func (o *OpenAI) Requests() []Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]Request(nil), o.requests...)
+}
+
+// Chats returns the messages of every chat completion request as
+// "role: content".
+func (o *OpenAI) Chats() [][]string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([][]string(nil), o.chats...)
+}
+
+// Assistants returns the bodies of the created assistants.
+func (o *OpenAI) Assistants() []I {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]I(nil), o.assistants...)
+}
+
+func (o *OpenAI) Files() []File {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]File(nil), o.files...)
+}
+
+// Attachments returns the ids of the files attached to the thread's messages.
+func (o *OpenAI) Attachments(threadId string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var ids []string
+	for _, m := range o.threads[threadId] {
+		for _, attachment := range m.Attachments {
+			ids = append(ids, str(attachment["file_id"]))
+		}
+	}
+
+	return ids
+}
+
+// Images returns the file ids and urls of the image parts of the thread's
+// messages.
+func (o *OpenAI) Images(threadId string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var images []string
+	for _, m := range o.threads[threadId] {
+		for _, part := range m.Content {
+			switch part["type"] {
+			case "image_file":
+				images = append(images, str(part["image_file"].(I)["file_id"]))
+			case "image_url":
+				images = append(images, str(part["image_url"].(I)["url"]))
+			}
+		}
+	}
+
+	return images
+}
+
+func (o *OpenAI) id(prefix string) string {
+	o.ids++
+	return fmt.Sprintf("%s_%d", prefix, o.ids)
+}
+
+// routes: /v1/files, /v1/threads[/{threadId}/(messages|runs[/{runId}[/(cancel|submit_tool_outputs)]])]
+// the Azure paths /openai/... and /openai/deployments/{deployment}/chat/completions
+// are served the same
+func (o *OpenAI) handle(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.requests = append(o.requests, Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Time: time.Now()})
+	o.mu.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, "/openai/deployments/") && strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		r.URL.Path = "/v1/chat/completions"
+	} else if strings.HasPrefix(r.URL.Path, "/openai/") {
+		r.URL.Path = "/v1/" + strings.TrimPrefix(r.URL.Path, "/openai/")
+	}
+
+	if r.URL.Path == "/v1/files" && r.Method == http.MethodPost {
+		o.upload(w, r)
+		return
+	}
+
+	var body I
+	json.NewDecoder(r.Body).Decode(&body)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(parts) < 2 || parts[0] != "v1" {
+		writeError(w, http.StatusNotFound, "unknown path")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "threads":
+		id := o.id("thread")
+		o.threads[id] = nil
+		writeJson(w, I{"id": id, "object": "thread"})
+
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[1] == "chat" && parts[2] == "completions":
+		o.chat(w, body)
+
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "assistants":
+		// v2 replaced retrieval and file_ids with file_search and tool_resources
+		if _, ok := body["file_ids"]; ok {
+			writeError(w, http.StatusBadRequest, "Unknown parameter: 'file_ids'.")
+			return
+		}
+
+		for _, tool := range body["tools"].([]interface{}) {
+			if tool.(I)["type"] == "retrieval" {
+				writeError(w, http.StatusBadRequest, "The requested tool retrieval is not supported.")
+				return
+			}
+		}
+
+		o.assistants = append(o.assistants, body)
+		writeJson(w, I{"id": o.id("asst"), "object": "assistant"})
+
+	case len(parts) >= 4 && parts[1] == "threads":
+		threadId := parts[2]
+		if _, ok := o.threads[threadId]; !ok {
+			writeError(w, http.StatusNotFound, "no thread found with id '"+threadId+"'")
+			return
+		}
+
+		o.handleThread(w, r, threadId, parts[3:], body)
+
+	default:
+		writeError(w, http.StatusNotFound, "unknown path")
+	}
+}
+
+func (o *OpenAI) handleThread(w http.ResponseWriter, r *http.Request, threadId string, parts []string, body I) {
+	switch {
+	case parts[0] == "messages" && r.Method == http.MethodPost:
+		m := message{Id: o.id("msg"), Role: "user", Content: []I{{"type": "text", "text": I{"value": content(body["content"])}}}}
+		if parts, ok := body["content"].([]interface{}); ok {
+			for _, part := range parts {
+				if part := part.(I); part["type"] != "text" {
+					m.Content = append(m.Content, part)
+				}
+			}
+		}
+
+		if attachments, ok := body["attachments"].([]interface{}); ok {
+			for _, attachment := range attachments {
+				m.Attachments = append(m.Attachments, attachment.(I))
+			}
+		}
+
+		o.threads[threadId] = append(o.threads[threadId], m)
+		writeJson(w, m)
+
+	case parts[0] == "messages" && r.Method == http.MethodGet:
+		writeJson(w, I{"data": o.newer(threadId, r.URL.Query().Get("before"))})
+
+	case parts[0] == "runs" && len(parts) == 1 && r.Method == http.MethodPost:
+		statuses := o.RunStatuses
+		if len(statuses) == 0 {
+			statuses = []string{"queued", "in_progress", "completed"}
+		}
+
+		run := &run{Id: o.id("run"), ThreadId: threadId, Model: "gpt-4o", statuses: statuses}
+		o.runs[run.Id] = run
+		o.advance(run)
+
+		if body["stream"] == true {
+			o.stream(w, run, true)
+			return
+		}
+
+		writeJson(w, run)
+
+	case parts[0] == "runs" && len(parts) >= 2:
+		run, ok := o.runs[parts[1]]
+		if !ok || run.ThreadId != threadId {
+			writeError(w, http.StatusNotFound, "no run found with id '"+parts[1]+"'")
+			return
+		}
+
+		switch {
+		case len(parts) == 2 && r.Method == http.MethodGet:
+			o.advance(run)
+			writeJson(w, run)
+
+		case len(parts) == 3 && parts[2] == "cancel":
+			run.Status = "cancelled"
+			run.statuses = []string{"cancelled"}
+			run.step = 0
+			writeJson(w, run)
+
+		case len(parts) == 3 && parts[2] == "submit_tool_outputs":
+			if run.Status != "requires_action" {
+				writeError(w, http.StatusBadRequest, "run is not waiting for tool outputs")
+				return
+			}
+
+			b, _ := json.Marshal(body["tool_outputs"])
+			var outputs []openai.ToolOutput
+			json.Unmarshal(b, &outputs)
+			o.toolOutputs = append(o.toolOutputs, outputs...)
+
+			run.RequiredAction = nil
+			run.step++
+			o.advance(run)
+
+			if body["stream"] == true {
+				o.stream(w, run, false)
+				return
+			}
+
+			writeJson(w, run)
+
+		default:
+			writeError(w, http.StatusNotFound, "unknown path")
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, "unknown path")
+	}
+}
+
+// https://platform.openai.com/docs/api-reference/files/create
+func (o *OpenAI) upload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f := File{Id: o.id("file"), Filename: header.Filename, Purpose: r.FormValue("purpose"), Content: b}
+	o.files = append(o.files, f)
+
+	writeJson(w, I{"id": f.Id, "object": "file", "bytes": len(b), "filename": f.Filename, "purpose": f.Purpose})
+}
+
+// https://platform.openai.com/docs/api-reference/chat/create
+func (o *OpenAI) chat(w http.ResponseWriter, body I) {
+	var messages []openai.ChatMessage
+	b, _ := json.Marshal(body["messages"])
+	json.Unmarshal(b, &messages)
+
+	var chat []string
+	for _, m := range messages {
+		chat = append(chat, m.Role+": "+content(m.Content))
+	}
+	o.chats = append(o.chats, chat)
+
+	last := messages[len(messages)-1]
+	answer := openai.ChatMessage{Role: "assistant"}
+
+	switch {
+	case last.Role == "user" && len(o.ToolCalls) > 0:
+		answer.ToolCalls = o.ToolCalls
+
+	default:
+		for _, m := range messages {
+			if m.Role == "tool" {
+				o.toolOutputs = append(o.toolOutputs, openai.ToolOutput{ToolCallId: m.ToolCallId, Output: content(m.Content)})
+			}
+		}
+
+		var question string
+		for _, m := range messages {
+			if m.Role == "user" {
+				question = content(m.Content)
+			}
+		}
+
+		answer.Content = "echo: " + strings.TrimSpace(question)
+		if o.Answer != nil {
+			answer.Content = o.Answer("", question)
+		}
+	}
+
+	id := o.id("chatcmpl")
+	usage := o.Usage
+
+	if body["stream"] != true {
+		writeJson(w, openai.ChatCompletion{Id: id, Model: "gpt-4o", Choices: []openai.ChatChoice{{Message: answer, FinishReason: "stop"}}, Usage: &usage})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	chunk := func(delta I) {
+		b, _ := json.Marshal(I{"id": id, "model": "gpt-4o", "choices": []I{{"index": 0, "delta": delta}}})
+		fmt.Fprintf(w, "data: %s\n\n", b)
+	}
+
+	for _, word := range strings.SplitAfter(answer.Text(), " ") {
+		chunk(I{"content": word})
+	}
+
+	for i, call := range answer.ToolCalls {
+		chunk(I{"tool_calls": []I{{"index": i, "id": call.Id, "type": call.Type, "function": call.Function}}})
+	}
+
+	b, _ = json.Marshal(I{"id": id, "model": "gpt-4o", "choices": []I{}, "usage": usage})
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", b)
+}
+
+// advance moves the run to its next status. The answer is added on the
+// transition to "completed".
+func (o *OpenAI) advance(run *run) {
+	if run.Status == "requires_action" && run.RequiredAction != nil {
+		return
+	}
+
+	if run.step >= len(run.statuses) {
+		return
+	}
+
+	run.Status = run.statuses[run.step]
+	run.step++
+
+	switch run.Status {
+	case "requires_action":
+		run.step--
+		run.RequiredAction = &openai.RequiredAction{Type: "submit_tool_outputs"}
+		run.RequiredAction.SubmitToolOutputs.ToolCalls = o.ToolCalls
+
+	case "completed":
+		o.answer(run.ThreadId)
+
+		usage := o.Usage
+		run.Usage = &usage
+
+	case "failed", "expired":
+		run.LastError = o.LastError
+	}
+}
+
+func (o *OpenAI) answer(threadId string) message {
+	messages := o.threads[threadId]
+
+	var last string
+	for _, m := range messages {
+		if m.Role == "user" {
+			last = text(m)
+		}
+	}
+
+	answer := "echo: " + strings.TrimSpace(last)
+	if o.Answer != nil {
+		answer = o.Answer(threadId, last)
+	}
+
+	m := message{Id: o.id("msg"), Role: "assistant", Content: []I{{"type": "text", "text": I{"value": answer}}}}
+	o.threads[threadId] = append(messages, m)
+
+	return m
+}
+
+// stream writes the remaining statuses of the run as server-sent events, it
+// stops at "requires_action" like the real API.
+func (o *OpenAI) stream(w http.ResponseWriter, run *run, created bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	event := func(name string, data interface{}) {
+		b, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	}
+
+	if created {
+		event("thread.run.created", run)
+	}
+
+	for {
+		switch run.Status {
+		case "completed":
+			answer := o.threads[run.ThreadId][len(o.threads[run.ThreadId])-1]
+			for _, word := range strings.SplitAfter(text(answer), " ") {
+				event("thread.message.delta", I{"id": answer.Id, "delta": I{"content": []I{{"index": 0, "type": "text", "text": I{"value": word}}}}})
+			}
+
+			event("thread.run.completed", run)
+			fmt.Fprint(w, "event: done\ndata: [DONE]\n\n")
+			return
+
+		case "requires_action", "failed", "expired", "cancelled":
+			event("thread.run."+run.Status, run)
+			return
+
+		default:
+			event("thread.run."+run.Status, run)
+		}
+
+		if run.step >= len(run.statuses) {
+			return
+		}
+
+		o.advance(run)
+	}
+}
+
+// newer returns the messages created after the given one, newest first like
+// the real API with the "before" cursor.
+func (o *OpenAI) newer(threadId, before string) []message {
+	messages := o.threads[threadId]
+	newer := []message{}
+
+	for i := len(messages) - 1; i >= 0 && messages[i].Id != before; i-- {
+		newer = append(newer, messages[i])
+	}
+
+	return newer
+}
+
+func text(m message) string {
+	var parts []string
+
+	for _, c := range m.Content {
+		if t, ok := c["text"].(I); ok {
+			parts = append(parts, str(t["value"]))
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// content flattens string and multi-part message content
+func content(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	var parts []string
+
+	if list, ok := v.([]interface{}); ok {
+		for _, item := range list {
+			if part, ok := item.(I); ok && part["type"] == "text" {
+				parts = append(parts, str(part["text"]))
+			}
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(I{"error": I{"message": message}, "message": message})
+}
@@ -0,0 +1,334 @@
+// Package testserver provides in-process stand-ins for the Slack Web API, its
+// Socket Mode WebSocket and the OpenAI Assistants API. Point SLACK_API_URL and
+// OPENAI_API_URL at their URL to exercise the real clients without network
+// access.
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+)
+
+type I = map[string]interface{}
+
+// Call is a request the Slack server received.
+type Call struct {
+	// e.g. chat.postMessage
+	Method string
+	// bearer token the request was sent with
+	Token  string
+	Params I
+}
+
+// Slack fakes the Web API methods the bot uses. Posted messages are kept per
+// channel, so conversations.replies returns what the bot wrote.
+type Slack struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	calls    []Call
+	messages map[string][]I
+	ts       int
+
+	// returned by users.info and users.profile.get
+	Users map[string]*slack.User
+	// returned by conversations.info
+	Conversations map[string]*slack.Conversation
+	// returned by apps.connections.open
+	SocketUrl string
+	// bot user of the posted messages
+	BotId     string
+	BotUserId string
+	// returned by oauth.v2.access for the code
+	Installs map[string]*slack.OAuthAccess
+	// served by path, use FileUrl for the url_private
+	Files map[string][]byte
+}
+
+func NewSlack() *Slack {
+	s := &Slack{
+		messages:      map[string][]I{},
+		Users:         map[string]*slack.User{},
+		Conversations: map[string]*slack.Conversation{},
+		Installs:      map[string]*slack.OAuthAccess{},
+		Files:         map[string][]byte{},
+		BotId:         "B0BOT",
+		BotUserId:     "U0BOT",
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Calls returns the received requests, optionally only those of the given
+// methods.
+func (s *Slack) Calls(methods ...string) []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var calls []Call
+
+	for _, call := range s.calls {
+		if len(methods) == 0 || contains(methods, call.Method) {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// Messages returns the messages of the channel, oldest first.
+func (s *Slack) Messages(channel string) []I {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]I(nil), s.messages[channel]...)
+}
+
+// AddMessage adds a message to the channel history, e.g. the user message an
+// event is about, and returns its ts.
+func (s *Slack) AddMessage(channel string, message I) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addMessage(channel, message)
+}
+
+func (s *Slack) addMessage(channel string, message I) string {
+	if _, ok := message["ts"]; !ok {
+		s.ts++
+		// later than any message of the tests
+		message["ts"] = fmt.Sprintf("%d.%06d", time.Now().Unix(), s.ts)
+	}
+
+	s.messages[channel] = append(s.messages[channel], message)
+
+	return message["ts"].(string)
+}
+
+// FileUrl returns the url_private of a file in Files.
+func (s *Slack) FileUrl(path string) string {
+	return s.URL + "/files/" + path
+}
+
+func (s *Slack) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/files/") {
+		s.download(w, r)
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+	params := I{}
+
+	for key := range r.URL.Query() {
+		params[key] = r.URL.Query().Get(key)
+	}
+
+	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		r.ParseForm()
+		for key := range r.PostForm {
+			params[key] = r.PostForm.Get(key)
+		}
+	} else if body, _ := io.ReadAll(r.Body); len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			writeJson(w, I{"ok": false, "error": "invalid_json"})
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = append(s.calls, Call{
+		Method: method,
+		Token:  strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		Params: params,
+	})
+
+	channel := str(params["channel"])
+
+	switch method {
+	case "chat.postMessage":
+		message := I{"type": "message", "bot_id": s.BotId, "user": s.BotUserId}
+		for _, key := range []string{"text", "blocks", "thread_ts"} {
+			if value, ok := params[key]; ok && value != "" {
+				message[key] = value
+			}
+		}
+
+		ts := s.addMessage(channel, message)
+		writeJson(w, I{"ok": true, "channel": channel, "ts": ts, "message": message})
+
+	case "chat.update":
+		message := s.find(channel, params["ts"])
+		if message == nil {
+			writeJson(w, I{"ok": false, "error": "message_not_found"})
+			return
+		}
+
+		message["text"] = params["text"]
+		if blocks, ok := params["blocks"]; ok {
+			message["blocks"] = blocks
+		}
+
+		writeJson(w, I{"ok": true, "channel": channel, "ts": params["ts"]})
+
+	case "chat.delete":
+		messages := s.messages[channel]
+		for i, message := range messages {
+			if message["ts"] == params["ts"] {
+				s.messages[channel] = append(messages[:i:i], messages[i+1:]...)
+				break
+			}
+		}
+
+		writeJson(w, I{"ok": true, "channel": channel, "ts": params["ts"]})
+
+	case "conversations.replies":
+		// the cursor is the offset of the page, the first one has the parent
+		// message in addition to limit replies
+		replies := s.replies(channel, params["ts"])
+		offset, _ := strconv.Atoi(str(params["cursor"]))
+		limit, _ := strconv.Atoi(str(params["limit"]))
+
+		if offset > len(replies) {
+			offset = len(replies)
+		}
+
+		if offset == 0 && limit > 0 {
+			limit++
+		}
+
+		end := len(replies)
+		if limit > 0 && offset+limit < end {
+			end = offset + limit
+		}
+
+		res := I{"ok": true, "messages": replies[offset:end], "has_more": end < len(replies)}
+		if end < len(replies) {
+			res["response_metadata"] = I{"next_cursor": strconv.Itoa(end)}
+		}
+
+		writeJson(w, res)
+
+	case "reactions.add", "reactions.remove":
+		writeJson(w, I{"ok": true})
+
+	case "users.info":
+		if user, ok := s.Users[str(params["user"])]; ok {
+			writeJson(w, I{"ok": true, "user": user})
+		} else {
+			writeJson(w, I{"ok": false, "error": "user_not_found"})
+		}
+
+	case "users.profile.get":
+		if user, ok := s.Users[str(params["user"])]; ok {
+			writeJson(w, I{"ok": true, "profile": user.Profile})
+		} else {
+			writeJson(w, I{"ok": false, "error": "user_not_found"})
+		}
+
+	case "conversations.info":
+		if conversation, ok := s.Conversations[channel]; ok {
+			writeJson(w, I{"ok": true, "channel": conversation})
+		} else {
+			writeJson(w, I{"ok": false, "error": "channel_not_found"})
+		}
+
+	case "oauth.v2.access":
+		if install, ok := s.Installs[str(params["code"])]; ok {
+			install.Ok = true
+			writeJson(w, install)
+		} else {
+			writeJson(w, I{"ok": false, "error": "invalid_code"})
+		}
+
+	case "apps.connections.open":
+		writeJson(w, I{"ok": s.SocketUrl != "", "url": s.SocketUrl})
+
+	default:
+		writeJson(w, I{"ok": false, "error": "unknown_method"})
+	}
+}
+
+// files are private, without token slack redirects to its login page
+func (s *Slack) download(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.calls = append(s.calls, Call{Method: "files", Token: token, Params: I{"path": r.URL.Path}})
+
+	b, ok := s.Files[strings.TrimPrefix(r.URL.Path, "/files/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if token == "" {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html>login</html>")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+func (s *Slack) find(channel string, ts interface{}) I {
+	for _, message := range s.messages[channel] {
+		if message["ts"] == ts {
+			return message
+		}
+	}
+
+	return nil
+}
+
+// replies returns the parent message and its replies, oldest first.
+func (s *Slack) replies(channel string, ts interface{}) []I {
+	replies := []I{}
+
+	for _, message := range s.messages[channel] {
+		if message["ts"] == ts || message["thread_ts"] == ts {
+			replies = append(replies, message)
+		}
+	}
+
+	sort.SliceStable(replies, func(i, j int) bool {
+		return replies[i]["ts"].(string) < replies[j]["ts"].(string)
+	})
+
+	return replies
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func str(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
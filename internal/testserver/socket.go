@@ -0,0 +1,114 @@
+package testserver
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Socket fakes the WebSocket of Socket Mode. Every connection is greeted with
+// hello, envelopes are sent with Send and the acknowledgements recorded. Set
+// Slack.SocketUrl to Url, so apps.connections.open points at it.
+// https://api.slack.com/apis/connections/socket-mode
+type Socket struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	conn        *websocket.Conn
+	connections int
+	acks        []string
+}
+
+func NewSocket() *Socket {
+	s := &Socket{}
+
+	s.Server = httptest.NewServer(websocket.Handler(s.handle))
+
+	return s
+}
+
+// Url is the ws:// address of the server
+func (s *Socket) Url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// Connections returns how many connections were opened so far
+func (s *Socket) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections
+}
+
+// Acks returns the acknowledged envelope ids in order
+func (s *Socket) Acks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.acks...)
+}
+
+// Send writes an envelope to the latest connection
+func (s *Socket) Send(envelope I) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return websocket.JSON.Send(conn, envelope)
+}
+
+// Disconnect asks the client to reconnect, like Slack does before it
+// refreshes a connection
+func (s *Socket) Disconnect(reason string) error {
+	return s.Send(I{"type": "disconnect", "reason": reason})
+}
+
+// Drop closes the latest connection without notice
+func (s *Socket) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *Socket) Close() {
+	s.Drop()
+	s.Server.Close()
+}
+
+func (s *Socket) handle(conn *websocket.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.connections++
+	s.mu.Unlock()
+
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, I{"type": "hello"}); err != nil {
+		return
+	}
+
+	for {
+		var ack struct {
+			EnvelopeId string `json:"envelope_id"`
+		}
+
+		if err := websocket.JSON.Receive(conn, &ack); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.acks = append(s.acks, ack.EnvelopeId)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,160 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dominikwinter/slackgpt/internal/client/openai"
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+)
+
+type I = map[string]interface{}
+
+type userArguments struct {
+	UserId string `json:"user_id"`
+}
+
+type channelArguments struct {
+	ChannelId string `json:"channel_id"`
+}
+
+// what the model gets to know about a colleague
+type user struct {
+	Id          string `json:"id"`
+	RealName    string `json:"real_name"`
+	DisplayName string `json:"display_name,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Pronouns    string `json:"pronouns,omitempty"`
+	Tz          string `json:"tz,omitempty"`
+	TzLabel     string `json:"tz_label,omitempty"`
+	IsBot       bool   `json:"is_bot,omitempty"`
+}
+
+type channel struct {
+	Id         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Type       string `json:"type"`
+	Topic      string `json:"topic,omitempty"`
+	Purpose    string `json:"purpose,omitempty"`
+	NumMembers int    `json:"num_members,omitempty"`
+}
+
+// RegisterSlack adds tools to resolve Slack users and channels. The client is
+// only used when a tool is called, creating an assistant needs the
+// definitions only.
+func RegisterSlack(tools *openai.Tools, client *slack.Client) {
+	tools.Register(openai.Tool{
+		Name:        "get_slack_user",
+		Description: "Look up a Slack user by id, e.g. U069DBU1TGQ for the mention <@U069DBU1TGQ>. Returns the real name, job title, pronouns and time zone.",
+		Parameters: I{
+			"type": "object",
+			"properties": I{
+				"user_id": I{"type": "string", "description": "Slack user id, without <@ and >"},
+			},
+			"required": []string{"user_id"},
+		},
+		Func: func(ctx context.Context, arguments json.RawMessage) (string, error) {
+			var args userArguments
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %w", err)
+			}
+
+			return getUser(ctx, client, strings.Trim(args.UserId, "<@>"))
+		},
+	})
+
+	tools.Register(openai.Tool{
+		Name:        "get_slack_channel",
+		Description: "Look up a Slack channel by id. Returns its name, type, topic and purpose.",
+		Parameters: I{
+			"type": "object",
+			"properties": I{
+				"channel_id": I{"type": "string", "description": "Slack channel id, e.g. C024BE91L"},
+			},
+			"required": []string{"channel_id"},
+		},
+		Func: func(ctx context.Context, arguments json.RawMessage) (string, error) {
+			var args channelArguments
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %w", err)
+			}
+
+			return getChannel(ctx, client, args.ChannelId)
+		},
+	})
+}
+
+func getUser(ctx context.Context, client *slack.Client, userId string) (string, error) {
+	info, err := client.GetUserInfo(ctx, userId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user info: %w", err)
+	}
+
+	if !info.Ok || info.User == nil {
+		return "", fmt.Errorf("failed to get user info: %s", info.Error)
+	}
+
+	profile, err := client.GetUserProfile(ctx, userId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user profile: %w", err)
+	}
+
+	if !profile.Ok || profile.Profile == nil {
+		return "", fmt.Errorf("failed to get user profile: %s", profile.Error)
+	}
+
+	return encode(user{
+		Id:          info.User.Id,
+		RealName:    profile.Profile.RealName,
+		DisplayName: profile.Profile.DisplayName,
+		Title:       profile.Profile.Title,
+		Pronouns:    profile.Profile.Pronouns,
+		Tz:          info.User.Tz,
+		TzLabel:     info.User.TzLabel,
+		IsBot:       info.User.IsBot,
+	})
+}
+
+func getChannel(ctx context.Context, client *slack.Client, channelId string) (string, error) {
+	info, err := client.GetConversationInfo(ctx, channelId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get conversation info: %w", err)
+	}
+
+	if !info.Ok || info.Channel == nil {
+		return "", fmt.Errorf("failed to get conversation info: %s", info.Error)
+	}
+
+	return encode(channel{
+		Id:         info.Channel.Id,
+		Name:       info.Channel.Name,
+		Type:       channelType(info.Channel),
+		Topic:      info.Channel.Topic.Value,
+		Purpose:    info.Channel.Purpose.Value,
+		NumMembers: info.Channel.NumMembers,
+	})
+}
+
+func channelType(c *slack.Conversation) string {
+	switch {
+	case c.IsIm:
+		return "direct message"
+	case c.IsMpim:
+		return "group direct message"
+	case c.IsPrivate:
+		return "private channel"
+	default:
+		return "public channel"
+	}
+}
+
+func encode(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode result: %w", err)
+	}
+
+	return string(b), nil
+}
@@ -1,22 +1,36 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/logger"
 	"github.com/gofiber/fiber/v3/middleware/recover"
-	_ "github.com/joho/godotenv/autoload"
 
+	"github.com/dominikwinter/slackgpt/internal/client/slack"
+	"github.com/dominikwinter/slackgpt/internal/config"
 	"github.com/dominikwinter/slackgpt/internal/router"
 )
 
 func main() {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	var level slog.Leveler
 
-	if os.Getenv("DEBUG") == "true" {
+	if cfg.Debug {
 		level = slog.LevelDebug
 	} else {
 		level = slog.LevelInfo
@@ -24,6 +38,10 @@ func main() {
 
 	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 
+	// stops accepting new events, in-flight ones are drained below
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	app := fiber.New(fiber.Config{
 		ReadTimeout:  30 * time.Second,
 		IdleTimeout:  30 * time.Second,
@@ -33,9 +51,50 @@ func main() {
 	app.Use(recover.New(recover.Config{EnableStackTrace: true}))
 	app.Use(logger.New())
 
-	router.Setup(app, log)
+	handler, err := router.New(cfg, log)
+	if err != nil {
+		log.Error("failed to set up router", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	switch cfg.Slack.Transport {
+	case "socket":
+		handler.SetupSocketMode(ctx, slack.New(cfg.Slack.ApiUrl, cfg.Slack.AppToken))
+	default:
+		handler.Setup(ctx, app, cfg.Slack.SigningSecret)
+	}
+
+	if cfg.Slack.OAuth() {
+		handler.SetupOAuth(app, cfg.Slack)
+	}
+
+	if len(cfg.Usage.ApiKeys) > 0 {
+		handler.SetupUsage(app, cfg.Usage)
+	}
+
+	go func() {
+		if err := app.Listen(":" + cfg.Port); err != nil {
+			log.Error("failed to start server", slog.Any("error", err))
+		}
+		stop()
+	}()
+
+	<-ctx.Done()
+
+	log.Info("shutting down", slog.Duration("timeout", cfg.ShutdownTimeout))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := app.ShutdownWithContext(shutdownCtx); err != nil {
+		log.Error("failed to shut down server", slog.Any("error", err))
+	}
+
+	if err := handler.Shutdown(shutdownCtx); err != nil {
+		log.Error("failed to drain events", slog.Any("error", err))
+	}
 
-	if err := app.Listen(":" + os.Getenv("PORT")); err != nil {
-		log.Error("failed to start server", slog.Any("error", err))
+	if err := handler.Close(); err != nil {
+		log.Error("failed to close stores", slog.Any("error", err))
 	}
 }